@@ -3,12 +3,26 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
-	"github.com/antonholmquist/jason"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 type Slack struct {
@@ -18,57 +32,531 @@ type Slack struct {
 	Message    string
 }
 
-func send(s Slack) {
-	jsonStr := `{"channel":"` + s.Channel +
-		`","username":"` + s.Name +
-		`","text":"` + s.Message + `"}`
+// slackClient posts to the incoming webhook. The timeout covers one
+// attempt; the Lambda deadline in ctx covers the retries.
+var slackClient = &http.Client{Timeout: 10 * time.Second}
 
-	req, err := http.NewRequest(
-		"POST",
-		s.WebhookURL,
-		bytes.NewBuffer([]byte(jsonStr)),
-	)
+// Retries of a failed post. The wait doubles after each attempt, or is
+// the Retry-After of a rate limited response.
+var (
+	slackRetries = 3
+	slackBackoff = time.Second
+)
+
+// slackError is a response other than 2xx.
+type slackError struct {
+	status     int
+	body       string
+	retryAfter time.Duration
+}
+
+func (e *slackError) Error() string {
+	return fmt.Sprintf("Error slack responded %d %s", e.status, e.body)
+}
 
+// post sends the payload once.
+func post(ctx context.Context, webhookURL string, payload []byte) error {
+	req, err := http.NewRequest("POST", webhookURL, bytes.NewReader(payload))
 	if err != nil {
-		fmt.Print(err)
+		return errors.Wrap(err, "Error failed to create message")
 	}
-
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := slackClient.Do(req)
 	if err != nil {
-		fmt.Print(err)
+		return errors.Wrap(err, "Error failed to send Slack")
 	}
-
-	fmt.Print(resp)
 	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	e := &slackError{status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.retryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
 }
 
-func createMessage(message string) string {
-	json, err := jason.NewObjectFromBytes([]byte(message))
+// send posts the message and retries network errors, rate limits and
+// server errors. The last error is returned, so that SNS retries the
+// notification or sends it to the dead-letter queue.
+func send(ctx context.Context, s Slack) error {
+	if s.WebhookURL == "" {
+		return errors.New("Error SLACK_WEBHOOK_URL is not set")
+	}
+
+	payload, err := json.Marshal(struct {
+		Channel  string `json:"channel,omitempty"`
+		Username string `json:"username,omitempty"`
+		Text     string `json:"text"`
+	}{s.Channel, s.Name, s.Message})
 	if err != nil {
-		panic(err)
+		return errors.Wrap(err, "Error failed to create message")
+	}
+
+	wait := slackBackoff
+	for attempt := 0; ; attempt++ {
+		err = post(ctx, s.WebhookURL, payload)
+		if err == nil {
+			fmt.Println("send message", string(payload))
+			return nil
+		}
+		if attempt >= slackRetries {
+			return err
+		}
+
+		if e, ok := err.(*slackError); ok {
+			if e.status != http.StatusTooManyRequests && e.status < 500 {
+				return err
+			}
+			if e.retryAfter > 0 {
+				wait = e.retryAfter
+			}
+		}
+		fmt.Println(err, "retry in", wait)
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(err, "Error gave up sending Slack")
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// alertField is one line of the message.
+type alertField struct {
+	name  string
+	value string
+}
+
+// maxFieldLength cuts long values such as an event detail.
+const maxFieldLength = 1000
+
+// cutField cuts v to maxFieldLength bytes, back to the start of a rune so
+// that a multibyte character is not split.
+func cutField(v string) string {
+	if len(v) <= maxFieldLength {
+		return v
+	}
+	i := maxFieldLength
+	for i > 0 && !utf8.RuneStart(v[i]) {
+		i--
+	}
+	return v[:i] + "..."
+}
+
+// alertText renders the title, the fields in a code block and the console
+// link. The channel is mentioned unless the alert is a recovery.
+func alertText(mention bool, title string, fields []alertField, link string) string {
+	text := ""
+	if mention {
+		text = "<!channel> "
+	}
+	text += "*" + title + "*\n```\n"
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		text += fmt.Sprintf("%s\t:%s\n", f.name, cutField(f.value))
+	}
+	text += "```"
+	if link != "" {
+		text += "\n<" + link + "|Open in console>"
+	}
+	return text
+}
+
+// arnRegion returns the region of an ARN, or REGION.
+func arnRegion(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) > 3 && parts[3] != "" {
+		return parts[3]
+	}
+	return os.Getenv("REGION")
+}
+
+// consoleURL returns the CloudWatch console URL of the fragment.
+func consoleURL(region string, fragment string) string {
+	if region == "" {
+		return ""
+	}
+	return "https://" + region + ".console.aws.amazon.com/cloudwatch/home?region=" + region + "#" + fragment
+}
+
+// cloudWatchAlarm is the SNS message of a CloudWatch alarm.
+type cloudWatchAlarm struct {
+	AlarmName        string
+	AlarmDescription string
+	AWSAccountId     string
+	NewStateValue    string
+	NewStateReason   string
+	StateChangeTime  string
+	AlarmArn         string
+	OldStateValue    string
+	Trigger          struct {
+		MetricName         string
+		Namespace          string
+		Statistic          string
+		Period             int
+		EvaluationPeriods  int
+		ComparisonOperator string
+		Threshold          float64
+		Dimensions         []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		}
+	}
+}
+
+var comparisonOperators = map[string]string{
+	"GreaterThanOrEqualToThreshold": ">=",
+	"GreaterThanThreshold":          ">",
+	"LessThanThreshold":             "<",
+	"LessThanOrEqualToThreshold":    "<=",
+}
+
+// dimensions renders the dimensions as FunctionName=sendlog, ...
+func (a cloudWatchAlarm) dimensions() string {
+	dims := make([]string, 0, len(a.Trigger.Dimensions))
+	for _, d := range a.Trigger.Dimensions {
+		dims = append(dims, d.Name+"="+d.Value)
+	}
+	return strings.Join(dims, ", ")
+}
+
+// metric renders the alarm condition, e.g. AWS/Lambda Errors Sum > 0 (1 x 60s).
+func (a cloudWatchAlarm) metric() string {
+	t := a.Trigger
+	if t.MetricName == "" {
+		return ""
+	}
+	op, ok := comparisonOperators[t.ComparisonOperator]
+	if !ok {
+		op = t.ComparisonOperator
+	}
+	return fmt.Sprintf("%s %s %s %s %g (%d x %ds)", t.Namespace, t.MetricName, t.Statistic, op, t.Threshold, t.EvaluationPeriods, t.Period)
+}
+
+func (a cloudWatchAlarm) text() string {
+	title := a.NewStateValue + ": " + a.AlarmName
+	if a.OldStateValue != "" {
+		title += " (" + a.OldStateValue + " -> " + a.NewStateValue + ")"
+	}
+	link := consoleURL(arnRegion(a.AlarmArn), "alarmsV2:alarm/"+url.PathEscape(a.AlarmName))
+
+	return alertText(a.NewStateValue != "OK", title, []alertField{
+		{"description", a.AlarmDescription},
+		{"reason", a.NewStateReason},
+		{"metric", a.metric()},
+		{"dimensions", a.dimensions()},
+		{"time", a.StateChangeTime},
+		{"account", a.AWSAccountId},
+	}, link)
+}
+
+// lambdaDestination is the record sent by an asynchronous invocation
+// that failed all its retries.
+type lambdaDestination struct {
+	Timestamp      string `json:"timestamp"`
+	RequestContext struct {
+		RequestId              string `json:"requestId"`
+		FunctionArn            string `json:"functionArn"`
+		Condition              string `json:"condition"`
+		ApproximateInvokeCount int    `json:"approximateInvokeCount"`
+	} `json:"requestContext"`
+	ResponseContext struct {
+		StatusCode    int    `json:"statusCode"`
+		FunctionError string `json:"functionError"`
+	} `json:"responseContext"`
+	ResponsePayload struct {
+		ErrorType    string `json:"errorType"`
+		ErrorMessage string `json:"errorMessage"`
+	} `json:"responsePayload"`
+}
+
+// functionName returns the name of arn:aws:lambda:region:account:function:name[:version].
+func functionName(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) > 6 {
+		return parts[6]
+	}
+	return arn
+}
+
+// logGroupURL returns the console URL of the log group of the function.
+func logGroupURL(region string, function string) string {
+	group := strings.Replace(url.QueryEscape("/aws/lambda/"+function), "%", "$25", -1)
+	return consoleURL(region, "logsV2:log-groups/log-group/"+group)
+}
+
+func (d lambdaDestination) text() string {
+	c := d.RequestContext
+	name := functionName(c.FunctionArn)
+
+	invokes := ""
+	if c.ApproximateInvokeCount > 0 {
+		invokes = fmt.Sprint(c.ApproximateInvokeCount)
+	}
+	return alertText(true, "Lambda invocation failed: "+name, []alertField{
+		{"condition", c.Condition},
+		{"error", strings.TrimSpace(d.ResponsePayload.ErrorType + " " + d.ResponseContext.FunctionError)},
+		{"message", d.ResponsePayload.ErrorMessage},
+		{"request id", c.RequestId},
+		{"invokes", invokes},
+		{"time", d.Timestamp},
+	}, logGroupURL(arnRegion(c.FunctionArn), name))
+}
+
+// eventBridgeEvent is an EventBridge (CloudWatch Events) event.
+type eventBridgeEvent struct {
+	DetailType string          `json:"detail-type"`
+	Source     string          `json:"source"`
+	Account    string          `json:"account"`
+	Time       string          `json:"time"`
+	Region     string          `json:"region"`
+	Resources  []string        `json:"resources"`
+	Detail     json.RawMessage `json:"detail"`
+}
+
+// alarmStateChange is the detail of a "CloudWatch Alarm State Change" event.
+type alarmStateChange struct {
+	AlarmName string `json:"alarmName"`
+	State     struct {
+		Value     string `json:"value"`
+		Reason    string `json:"reason"`
+		Timestamp string `json:"timestamp"`
+	} `json:"state"`
+	PreviousState struct {
+		Value string `json:"value"`
+	} `json:"previousState"`
+	Configuration struct {
+		Description string `json:"description"`
+	} `json:"configuration"`
+}
+
+func (e eventBridgeEvent) text() string {
+	if e.Source == "aws.cloudwatch" && e.DetailType == "CloudWatch Alarm State Change" {
+		var d alarmStateChange
+		if json.Unmarshal(e.Detail, &d) == nil {
+			var a cloudWatchAlarm
+			a.AlarmName = d.AlarmName
+			a.AlarmDescription = d.Configuration.Description
+			a.AWSAccountId = e.Account
+			a.NewStateValue = d.State.Value
+			a.NewStateReason = d.State.Reason
+			a.StateChangeTime = d.State.Timestamp
+			a.OldStateValue = d.PreviousState.Value
+			if len(e.Resources) > 0 {
+				a.AlarmArn = e.Resources[0]
+			}
+			return a.text()
+		}
+	}
+
+	var detail bytes.Buffer
+	json.Compact(&detail, e.Detail)
+	return alertText(true, e.DetailType+" ("+e.Source+")", []alertField{
+		{"time", e.Time},
+		{"account", e.Account},
+		{"region", e.Region},
+		{"resources", strings.Join(e.Resources, ", ")},
+		{"detail", detail.String()},
+	}, "")
+}
+
+// createMessage renders the SNS message. CloudWatch alarms, Lambda
+// destinations and EventBridge events get their own layout; other JSON
+// is listed key by key and plain text is sent as it is.
+func createMessage(message string) string {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(message), &keys); err != nil {
+		return "<!channel>\n```\n" + message + "\n```"
+	}
+
+	switch {
+	case keys["AlarmName"] != nil:
+		var a cloudWatchAlarm
+		if json.Unmarshal([]byte(message), &a) == nil {
+			return a.text()
+		}
+	case keys["requestContext"] != nil && keys["responsePayload"] != nil:
+		var d lambdaDestination
+		if json.Unmarshal([]byte(message), &d) == nil {
+			return d.text()
+		}
+	case keys["detail-type"] != nil:
+		var e eventBridgeEvent
+		if json.Unmarshal([]byte(message), &e) == nil {
+			return e.text()
+		}
+	}
+
+	names := make([]string, 0, len(keys))
+	for k := range keys {
+		names = append(names, k)
 	}
+	sort.Strings(names)
 
 	text := "<!channel>\n```\n"
-	for k, v := range json.Map() {
-		s, sErr := v.String()
-		if sErr == nil {
-			text += fmt.Sprintf("%s\t:%s\n", k, s)
-		} else {
-			text += fmt.Sprintf("%s\t:%s\n", k, sErr)
+	for _, k := range names {
+		var s string
+		if json.Unmarshal(keys[k], &s) != nil {
+			// numbers, objects and arrays are shown as JSON.
+			var buf bytes.Buffer
+			json.Compact(&buf, keys[k])
+			s = buf.String()
 		}
+		text += fmt.Sprintf("%s\t:%s\n", k, s)
 	}
 	text += "```"
 
 	return text
 }
 
-// Send Slack notification from SNS event.
-func slackNotice(ctx context.Context, snsEvent events.SNSEvent) {
+// cloudWatchLogs is the part of the CloudWatch Logs API read for the log
+// excerpt. *cloudwatchlogs.CloudWatchLogs implements it.
+type cloudWatchLogs interface {
+	FilterLogEventsWithContext(ctx aws.Context, input *cloudwatchlogs.FilterLogEventsInput, opts ...request.Option) (*cloudwatchlogs.FilterLogEventsOutput, error)
+}
+
+// logsClient returns the CloudWatch Logs client; tests replace it.
+var logsClient = func() cloudWatchLogs {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("REGION")),
+	}))
+	return cloudwatchlogs.New(sess)
+}
+
+// defaultLogFilter matches the errors of the functions and of Lambda
+// itself (timeouts, crashed runtimes).
+const defaultLogFilter = `?ERROR ?Error ?error ?panic ?errorMessage ?"Task timed out" ?"Runtime exited"`
+
+var requestIDPattern = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+
+// lambdaFunction returns the function of a Lambda metric alarm, or "".
+func (a cloudWatchAlarm) lambdaFunction() string {
+	if a.Trigger.Namespace != "AWS/Lambda" {
+		return ""
+	}
+	for _, d := range a.Trigger.Dimensions {
+		if d.Name == "FunctionName" {
+			return d.Value
+		}
+	}
+	return ""
+}
+
+// window returns the period evaluated by the alarm, plus a minute for
+// the log delivery.
+func (a cloudWatchAlarm) window() (time.Time, time.Time) {
+	to, err := time.Parse("2006-01-02T15:04:05.000-0700", a.StateChangeTime)
+	if err != nil {
+		to = time.Now()
+	}
+	period := time.Duration(a.Trigger.Period*a.Trigger.EvaluationPeriods) * time.Second
+	if period <= 0 {
+		period = 5 * time.Minute
+	}
+	return to.Add(-period - time.Minute), to.Add(time.Minute)
+}
+
+// logExcerpt returns the last error lines of the function's log group and
+// the request id found in them.
+func logExcerpt(ctx context.Context, logs cloudWatchLogs, function string, from time.Time, to time.Time, lines int) ([]string, string, error) {
+	filter := os.Getenv("ALERT_LOG_FILTER")
+	if filter == "" {
+		filter = defaultLogFilter
+	}
+	input := &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName:  aws.String("/aws/lambda/" + function),
+		StartTime:     aws.Int64(from.UnixNano() / int64(time.Millisecond)),
+		EndTime:       aws.Int64(to.UnixNano() / int64(time.Millisecond)),
+		FilterPattern: aws.String(filter),
+	}
+
+	// the events come in ascending order, so every page is read and the
+	// last lines are kept in a ring.
+	last := make([]*cloudwatchlogs.FilteredLogEvent, lines)
+	n := 0
+	for {
+		out, err := logs.FilterLogEventsWithContext(ctx, input)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "Error failed to filter log events of "+function)
+		}
+		for _, e := range out.Events {
+			last[n%lines] = e
+			n++
+		}
+		if out.NextToken == nil {
+			break
+		}
+		input.NextToken = out.NextToken
+	}
+
+	first := 0
+	if n > lines {
+		first = n - lines
+	}
+	excerpt := make([]string, 0, n-first)
+	requestID := ""
+	for i := first; i < n; i++ {
+		e := last[i%lines]
+		line := cutField(strings.TrimRight(aws.StringValue(e.Message), "\n"))
+		excerpt = append(excerpt, line)
+		if id := requestIDPattern.FindString(line); id != "" {
+			requestID = id
+		}
+	}
+	return excerpt, requestID, nil
+}
+
+// alarmExcerpt returns the log excerpt appended to a Lambda alarm, or "".
+// A failure to read the logs does not hold back the alert.
+func alarmExcerpt(ctx context.Context, message string) string {
+	lines, err := strconv.Atoi(os.Getenv("ALERT_LOG_LINES"))
+	if err != nil {
+		lines = 5
+	}
+	if lines <= 0 {
+		return ""
+	}
+
+	var a cloudWatchAlarm
+	if json.Unmarshal([]byte(message), &a) != nil || a.NewStateValue != "ALARM" {
+		return ""
+	}
+	function := a.lambdaFunction()
+	if function == "" {
+		return ""
+	}
+
+	from, to := a.window()
+	excerpt, requestID, err := logExcerpt(ctx, logsClient(), function, from, to, lines)
+	if err != nil {
+		fmt.Println(err)
+		return ""
+	}
+	if len(excerpt) == 0 {
+		return ""
+	}
+
+	title := "log excerpt of " + function
+	if requestID != "" {
+		title += " (request id " + requestID + ")"
+	}
+	return "\n*" + title + "*\n```\n" + strings.Join(excerpt, "\n") + "\n```"
+}
+
+// Send Slack notification from SNS event. Every record is sent; the first
+// error is returned.
+func slackNotice(ctx context.Context, snsEvent events.SNSEvent) error {
 	fmt.Printf("events %s \n", snsEvent.Records)
 
+	var firstErr error
 	for _, record := range snsEvent.Records {
 		snsRecord := record.SNS
 		fmt.Printf("[%s %s] Message = %s \n", record.EventSource, snsRecord.Timestamp, snsRecord.Message)
@@ -76,12 +564,25 @@ func slackNotice(ctx context.Context, snsEvent events.SNSEvent) {
 		var s = Slack{os.Getenv("SLACK_WEBHOOK_URL"),
 			os.Getenv("SLACK_CHANNEL"),
 			os.Getenv("SLACK_NAME"),
-			createMessage(snsRecord.Message)}
+			createMessage(snsRecord.Message) + alarmExcerpt(ctx, snsRecord.Message)}
 
-		send(s)
+		if err := send(ctx, s); err != nil {
+			fmt.Println(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
 	}
+	return firstErr
 }
 
 func main() {
+	if !isLambda() {
+		if err := runSNS(os.Args[1:], os.Stdin, os.Stdout, slackNotice); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 	lambda.Start(slackNotice)
 }
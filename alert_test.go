@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+const testAlarm = `{"AlarmName":"alert-lambda-failure","AlarmDescription":"sendlog errors","AWSAccountId":"123456789012","NewStateValue":"ALARM","NewStateReason":"Threshold Crossed: 1 datapoint [2.0 (24/08/19 06:37:00)] was greater than or equal to the threshold (1.0).","StateChangeTime":"2019-08-24T06:38:33.123+0000","Region":"Asia Pacific (Tokyo)","AlarmArn":"arn:aws:cloudwatch:ap-northeast-1:123456789012:alarm:alert-lambda-failure","OldStateValue":"OK","Trigger":{"MetricName":"Errors","Namespace":"AWS/Lambda","StatisticType":"Statistic","Statistic":"SUM","Unit":null,"Dimensions":[{"value":"sendlog","name":"FunctionName"}],"Period":60,"EvaluationPeriods":1,"ComparisonOperator":"GreaterThanOrEqualToThreshold","Threshold":1.0,"TreatMissingData":"","EvaluateLowSampleCountPercentile":""}}`
+
+func TestCreateMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    []string
+	}{
+		{"cloudwatch alarm", testAlarm, []string{
+			"<!channel> *ALARM: alert-lambda-failure (OK -> ALARM)*",
+			"reason\t:Threshold Crossed",
+			"metric\t:AWS/Lambda Errors SUM >= 1 (1 x 60s)",
+			"dimensions\t:FunctionName=sendlog",
+			"<https://ap-northeast-1.console.aws.amazon.com/cloudwatch/home?region=ap-northeast-1#alarmsV2:alarm/alert-lambda-failure|Open in console>",
+		}},
+		{"lambda destination", `{"version":"1.0","timestamp":"2019-08-24T06:37:33.123Z","requestContext":{"requestId":"c6af9ac6-7b61-11e6-9a41-93e812345678","functionArn":"arn:aws:lambda:ap-northeast-1:123456789012:function:sendlog:$LATEST","condition":"RetriesExhausted","approximateInvokeCount":3},"requestPayload":{},"responseContext":{"statusCode":200,"executedVersion":"$LATEST","functionError":"Unhandled"},"responsePayload":{"errorMessage":"Error failed to s3 upload","errorType":"errorString"}}`, []string{
+			"<!channel> *Lambda invocation failed: sendlog*",
+			"condition\t:RetriesExhausted",
+			"message\t:Error failed to s3 upload",
+			"request id\t:c6af9ac6-7b61-11e6-9a41-93e812345678",
+			"#logsV2:log-groups/log-group/$252Faws$252Flambda$252Fsendlog|Open in console>",
+		}},
+		{"eventbridge alarm", `{"version":"0","id":"1","detail-type":"CloudWatch Alarm State Change","source":"aws.cloudwatch","account":"123456789012","time":"2019-08-24T06:38:33Z","region":"ap-northeast-1","resources":["arn:aws:cloudwatch:ap-northeast-1:123456789012:alarm:alert-lambda-failure"],"detail":{"alarmName":"alert-lambda-failure","state":{"value":"OK","reason":"recovered","timestamp":"2019-08-24T06:38:33.123+0000"},"previousState":{"value":"ALARM"},"configuration":{"description":"sendlog errors"}}}`, []string{
+			"*OK: alert-lambda-failure (ALARM -> OK)*",
+			"reason\t:recovered",
+		}},
+		{"eventbridge event", `{"version":"0","id":"2","detail-type":"EC2 Instance State-change Notification","source":"aws.ec2","account":"123456789012","time":"2019-08-24T06:38:33Z","region":"ap-northeast-1","resources":["arn:aws:ec2:ap-northeast-1:123456789012:instance/i-0123"],"detail":{"instance-id":"i-0123","state":"stopped"}}`, []string{
+			"*EC2 Instance State-change Notification (aws.ec2)*",
+			`detail	:{"instance-id":"i-0123","state":"stopped"}`,
+		}},
+		{"other json", `{"a":"b","n":1,"o":{"k":"v"}}`, []string{
+			"a\t:b\n", "n\t:1\n", "o\t:{\"k\":\"v\"}\n",
+		}},
+		{"plain text", "sendlog failed", []string{
+			"<!channel>\n```\nsendlog failed\n```",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := createMessage(tt.message)
+			for _, w := range tt.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("got: %v\nwant: %v", got, w)
+				}
+			}
+		})
+	}
+
+	t.Run("multibyte value at the limit", func(t *testing.T) {
+		value := strings.Repeat("a", maxFieldLength-1) + "エラー"
+		got := alertText(false, "title", []alertField{{"message", value}}, "")
+		want := "message\t:" + strings.Repeat("a", maxFieldLength-1) + "...\n"
+		if !utf8.ValidString(got) || !strings.Contains(got, want) {
+			t.Errorf("got: %q\nwant: %q", got, want)
+		}
+	})
+
+	t.Run("recovery does not mention the channel", func(t *testing.T) {
+		got := createMessage(strings.Replace(testAlarm, `"NewStateValue":"ALARM"`, `"NewStateValue":"OK"`, 1))
+		if strings.Contains(got, "<!channel>") {
+			t.Errorf("got: %v", got)
+		}
+	})
+}
+
+// fakeLogs is an in-memory log group. It returns one event per page.
+type fakeLogs struct {
+	group  string
+	events []*cloudwatchlogs.FilteredLogEvent
+	inputs []cloudwatchlogs.FilterLogEventsInput
+}
+
+func (f *fakeLogs) FilterLogEventsWithContext(ctx aws.Context, input *cloudwatchlogs.FilterLogEventsInput, opts ...request.Option) (*cloudwatchlogs.FilterLogEventsOutput, error) {
+	f.inputs = append(f.inputs, *input)
+	if aws.StringValue(input.LogGroupName) != f.group {
+		return &cloudwatchlogs.FilterLogEventsOutput{}, nil
+	}
+
+	i := len(f.inputs) - 1
+	out := &cloudwatchlogs.FilterLogEventsOutput{}
+	if i < len(f.events) {
+		out.Events = f.events[i : i+1]
+	}
+	if i+1 < len(f.events) {
+		out.NextToken = aws.String("next")
+	}
+	return out, nil
+}
+
+func TestAlarmExcerpt(t *testing.T) {
+	logs := &fakeLogs{group: "/aws/lambda/sendlog"}
+	for _, m := range []string{
+		"START RequestId: c6af9ac6-7b61-11e6-9a41-93e812345678 Version: $LATEST",
+		"Error failed to s3 upload: RequestError: send request failed\n",
+		"{\"errorMessage\":\"Error failed to s3 upload\",\"errorType\":\"withStack\"}",
+		"END RequestId: c6af9ac6-7b61-11e6-9a41-93e812345678",
+	} {
+		logs.events = append(logs.events, &cloudwatchlogs.FilteredLogEvent{Message: aws.String(m)})
+	}
+
+	org := logsClient
+	logsClient = func() cloudWatchLogs { return logs }
+	defer func() { logsClient = org }()
+	os.Setenv("ALERT_LOG_LINES", "3")
+	defer os.Unsetenv("ALERT_LOG_LINES")
+
+	t.Run("lambda alarm", func(t *testing.T) {
+		got := alarmExcerpt(context.Background(), testAlarm)
+		want := "\n*log excerpt of sendlog (request id c6af9ac6-7b61-11e6-9a41-93e812345678)*\n```\n" +
+			"Error failed to s3 upload: RequestError: send request failed\n" +
+			"{\"errorMessage\":\"Error failed to s3 upload\",\"errorType\":\"withStack\"}\n" +
+			"END RequestId: c6af9ac6-7b61-11e6-9a41-93e812345678\n```"
+		if got != want {
+			t.Errorf("got: %v\nwant: %v", got, want)
+		}
+
+		// the evaluated period (1 x 60s) and a minute on each side.
+		in := logs.inputs[0]
+		from := time.Unix(0, aws.Int64Value(in.StartTime)*int64(time.Millisecond)).UTC()
+		to := time.Unix(0, aws.Int64Value(in.EndTime)*int64(time.Millisecond)).UTC()
+		if from.Format(time.RFC3339) != "2019-08-24T06:36:33Z" || to.Format(time.RFC3339) != "2019-08-24T06:39:33Z" {
+			t.Errorf("got: %v - %v", from, to)
+		}
+	})
+
+	t.Run("last lines of many pages", func(t *testing.T) {
+		many := &fakeLogs{group: "/aws/lambda/sendlog"}
+		for i := 0; i < 20; i++ {
+			many.events = append(many.events, &cloudwatchlogs.FilteredLogEvent{Message: aws.String("error " + strconv.Itoa(i))})
+		}
+		logsClient = func() cloudWatchLogs { return many }
+		defer func() { logsClient = func() cloudWatchLogs { return logs } }()
+
+		got := alarmExcerpt(context.Background(), testAlarm)
+		want := "\n*log excerpt of sendlog*\n```\nerror 17\nerror 18\nerror 19\n```"
+		if got != want {
+			t.Errorf("got: %v\nwant: %v", got, want)
+		}
+		if len(many.inputs) != len(many.events) {
+			t.Errorf("got: %v pages\nwant: %v", len(many.inputs), len(many.events))
+		}
+	})
+
+	t.Run("multibyte line at the limit", func(t *testing.T) {
+		long := &fakeLogs{group: "/aws/lambda/sendlog", events: []*cloudwatchlogs.FilteredLogEvent{
+			{Message: aws.String(strings.Repeat("a", maxFieldLength-2) + "エラー")},
+		}}
+		logsClient = func() cloudWatchLogs { return long }
+		defer func() { logsClient = func() cloudWatchLogs { return logs } }()
+
+		got := alarmExcerpt(context.Background(), testAlarm)
+		want := "\n" + strings.Repeat("a", maxFieldLength-2) + "...\n"
+		if !utf8.ValidString(got) || !strings.Contains(got, want) {
+			t.Errorf("got: %q\nwant: %q", got, want)
+		}
+	})
+
+	t.Run("other alarms", func(t *testing.T) {
+		for _, m := range []string{
+			strings.Replace(testAlarm, `"NewStateValue":"ALARM"`, `"NewStateValue":"OK"`, 1),
+			strings.Replace(testAlarm, `"Namespace":"AWS/Lambda"`, `"Namespace":"AWS/SQS"`, 1),
+			"sendlog failed",
+		} {
+			if got := alarmExcerpt(context.Background(), m); got != "" {
+				t.Errorf("got: %v\nwant: no excerpt", got)
+			}
+		}
+	})
+}
+
+func TestSend(t *testing.T) {
+	org := slackBackoff
+	slackBackoff = time.Millisecond
+	defer func() { slackBackoff = org }()
+
+	// server answers with the given statuses in turn and records the bodies.
+	server := func(statuses ...int) (*httptest.Server, *[]string) {
+		var bodies []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(b))
+			status := statuses[len(statuses)-1]
+			if len(bodies) <= len(statuses) {
+				status = statuses[len(bodies)-1]
+			}
+			w.WriteHeader(status)
+		}))
+		return ts, &bodies
+	}
+
+	t.Run("payload is json", func(t *testing.T) {
+		ts, bodies := server(http.StatusOK)
+		defer ts.Close()
+
+		message := "*ALARM*\n```\nreason\t:\"quoted\" \\ value\n```"
+		if err := send(context.Background(), Slack{ts.URL, "#alert", "bot", message}); err != nil {
+			t.Fatal(err)
+		}
+		var got struct {
+			Channel  string `json:"channel"`
+			Username string `json:"username"`
+			Text     string `json:"text"`
+		}
+		if err := json.Unmarshal([]byte((*bodies)[0]), &got); err != nil || got.Text != message || got.Channel != "#alert" {
+			t.Errorf("got: %v %+v", err, got)
+		}
+	})
+
+	t.Run("retry server errors", func(t *testing.T) {
+		ts, bodies := server(http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusOK)
+		defer ts.Close()
+
+		if err := send(context.Background(), Slack{ts.URL, "", "", "message"}); err != nil {
+			t.Fatal(err)
+		}
+		if len(*bodies) != 3 {
+			t.Errorf("got: %v\nwant: %v", len(*bodies), 3)
+		}
+	})
+
+	t.Run("give up", func(t *testing.T) {
+		ts, bodies := server(http.StatusServiceUnavailable)
+		defer ts.Close()
+
+		if err := send(context.Background(), Slack{ts.URL, "", "", "message"}); err == nil {
+			t.Error("got: nil\nwant: error")
+		}
+		if len(*bodies) != slackRetries+1 {
+			t.Errorf("got: %v\nwant: %v", len(*bodies), slackRetries+1)
+		}
+	})
+
+	t.Run("no retry of client errors", func(t *testing.T) {
+		ts, bodies := server(http.StatusNotFound)
+		defer ts.Close()
+
+		if err := send(context.Background(), Slack{ts.URL, "", "", "message"}); err == nil {
+			t.Error("got: nil\nwant: error")
+		}
+		if len(*bodies) != 1 {
+			t.Errorf("got: %v\nwant: %v", len(*bodies), 1)
+		}
+	})
+
+	t.Run("network error", func(t *testing.T) {
+		ts, _ := server(http.StatusOK)
+		ts.Close()
+
+		if err := send(context.Background(), Slack{ts.URL, "", "", "message"}); err == nil {
+			t.Error("got: nil\nwant: error")
+		}
+	})
+}
+
+func TestRunSNS(t *testing.T) {
+	os.Setenv("ALERT_LOG_LINES", "0")
+	defer os.Unsetenv("ALERT_LOG_LINES")
+
+	for _, tt := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"raw message", "sendlog failed\n", `"text":"\u003c!channel\u003e\n` + "```" + `\nsendlog failed\n` + "```" + `"`},
+		{"sns event", `{"Records":[{"EventSource":"aws:sns","Sns":{"Message":` + strconv.Quote(testAlarm) + `}}]}`, `*ALARM: alert-lambda-failure (OK -\u003e ALARM)*`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := runSNS(nil, strings.NewReader(tt.in), &out, slackNotice); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(out.String(), "slack {") || !strings.Contains(out.String(), tt.want) {
+				t.Errorf("got: %v\nwant: %v", out.String(), tt.want)
+			}
+		})
+	}
+
+	t.Run("log query", func(t *testing.T) {
+		org := os.Getenv("ALERT_LOG_LINES")
+		os.Setenv("ALERT_LOG_LINES", "5")
+		defer os.Setenv("ALERT_LOG_LINES", org)
+		var out bytes.Buffer
+		if err := runSNS(nil, strings.NewReader(testAlarm), &out, slackNotice); err != nil {
+			t.Fatal(err)
+		}
+		want := "logs /aws/lambda/sendlog 1566628593123-1566628773123 "
+		if !strings.HasPrefix(out.String(), want) || !strings.Contains(out.String(), "\nslack {") {
+			t.Errorf("got: %v\nwant: %v", out.String(), want)
+		}
+	})
+}
+
+func FuzzCreateMessage(f *testing.F) {
+	f.Add(testAlarm)
+	f.Add(`{"version":"1.0","requestContext":{"functionArn":"arn:aws:lambda:ap-northeast-1:123456789012:function:sendlog"},"responsePayload":{"errorMessage":"boom"}}`)
+	f.Add(`{"detail-type":"CloudWatch Alarm State Change","source":"aws.cloudwatch","detail":{}}`)
+	f.Add(`{"a":"b","n":1,"o":{"k":"v"}}`)
+	f.Add("sendlog failed")
+
+	f.Fuzz(func(t *testing.T, message string) {
+		if got := createMessage(message); strings.TrimSpace(got) == "" {
+			t.Errorf("got: %q\nwant: a message", got)
+		}
+	})
+}
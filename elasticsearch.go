@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/pkg/errors"
+	"github.com/sha1sum/aws_signing_client"
+	"gopkg.in/olivere/elastic.v6"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// templateVersion is raised whenever a mapping below changes.
+const templateVersion = 9
+
+// esTemplate describes the index template of one log type.
+// The Lambda functions write to the alias (or to a time-based index name)
+// only; the template and the ILM policy take care of the concrete indices.
+type esTemplate struct {
+	Name       string // template name
+	AliasEnv   string // environment variable holding the write alias or index pattern
+	TypeEnv    string // environment variable holding the mapping type (Elasticsearch 6 only)
+	MappingEnv string // environment variable holding a file replacing Properties
+	Properties string // mapping properties
+}
+
+var esTemplates = []esTemplate{
+	{"nginx_access", "ES_NGINX_INDEX", "ES_NGINX_INDEXTYPE", "ES_NGINX_MAPPING", nginxProperties},
+	{"application", "ES_APP_INDEX", "ES_APP_INDEXTYPE", "ES_APP_MAPPING", applicationProperties},
+	{"nginx_error", "ES_NGINX_ERROR_INDEX", "ES_NGINX_ERROR_INDEXTYPE", "ES_NGINX_ERROR_MAPPING", nginxErrorProperties},
+	{"php-fpm-error", "ES_PHP_ERROR_INDEX", "ES_PHP_ERROR_INDEXTYPE", "ES_PHP_ERROR_MAPPING", phpErrorProperties},
+}
+
+// "-" is written by nginx for empty values, so numeric and ip fields
+// ignore malformed values instead of rejecting the document.
+// The keys of query are unbounded, so it is kept in _source only.
+const nginxProperties = `{
+	"@timestamp":             {"type": "date"},
+	"time_original":          {"type": "keyword"},
+	"time_unparsed":          {"type": "boolean"},
+	"time":                   {"type": "date", "format": "strict_date_optional_time||yyyy-MM-dd HH:mm:ssZ", "ignore_malformed": true},
+	"remote_addr":            {"type": "ip", "ignore_malformed": true},
+	"host":                   {"type": "keyword"},
+	"request_method":         {"type": "keyword"},
+	"request_length":         {"type": "long", "ignore_malformed": true},
+	"request_uri":            {"type": "keyword", "fields": {"text": {"type": "text"}}},
+	"https":                  {"type": "keyword"},
+	"uri":                    {"type": "keyword"},
+	"query_string":           {"type": "keyword", "ignore_above": 2048},
+	"status":                 {"type": "short", "ignore_malformed": true},
+	"bytes_sent":             {"type": "long", "ignore_malformed": true},
+	"body_bytes_sent":        {"type": "long", "ignore_malformed": true},
+	"referer":                {"type": "keyword", "ignore_above": 2048},
+	"useragent":              {"type": "keyword", "ignore_above": 1024, "fields": {"text": {"type": "text"}}},
+	"http_x_amzn_trace_id":   {"type": "keyword"},
+	"http_x_amzn_apigateway_api_id": {"type": "keyword"},
+	"forwardedfor":           {"type": "keyword"},
+	"request_time":           {"type": "float", "ignore_malformed": true},
+	"upstream_response_time": {"type": "float", "ignore_malformed": true},
+	"client_ip":              {"type": "keyword"},
+	"trace_id":               {"type": "keyword"},
+	"route":                  {"type": "keyword"},
+	"query":                  {"type": "object", "enabled": false},
+	"geo": {"properties": {
+		"country_code": {"type": "keyword"},
+		"country":      {"type": "keyword"},
+		"city":         {"type": "keyword"},
+		"location":     {"type": "geo_point"},
+		"asn":          {"type": "long"},
+		"as_org":       {"type": "keyword"}
+	}},
+	"ua": {"properties": {
+		"browser":         {"type": "keyword"},
+		"browser_version": {"type": "keyword"},
+		"os":              {"type": "keyword"},
+		"os_version":      {"type": "keyword"},
+		"device":          {"type": "keyword"},
+		"bot":             {"type": "boolean"},
+		"bot_class":       {"type": "keyword"},
+		"bot_name":        {"type": "keyword"}
+	}}
+}`
+
+const applicationProperties = `{
+	"id":         {"type": "keyword"},
+	"system":     {"type": "keyword"},
+	"level":      {"type": "keyword"},
+	"@timestamp":    {"type": "date"},
+	"time_original": {"type": "keyword"},
+	"time_unparsed": {"type": "boolean"},
+	"datetime":   {"type": "keyword"},
+	"env":        {"type": "keyword"},
+	"message":    {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
+	"code":       {"type": "keyword"},
+	"file":       {"type": "keyword"},
+	"line":       {"type": "long", "ignore_malformed": true},
+	"response":   {"type": "text"},
+	"trace":      {"type": "text"},
+	"genre":      {"type": "keyword"},
+	"parameters": {"type": "text"},
+	"slack":      {"type": "object", "enabled": false},
+	"trace_id":   {"type": "keyword"},
+	"extra": {
+		"properties": {
+			"file":        {"type": "keyword"},
+			"line":        {"type": "long", "ignore_malformed": true},
+			"class":       {"type": "keyword"},
+			"function":    {"type": "keyword"},
+			"process_id":  {"type": "long", "ignore_malformed": true},
+			"url":         {"type": "keyword"},
+			"ip":          {"type": "ip", "ignore_malformed": true},
+			"http_method": {"type": "keyword"},
+			"server":      {"type": "keyword"},
+			"referrer":    {"type": "keyword"},
+			"trace_id":    {"type": "keyword"}
+		}
+	}
+}`
+
+const nginxErrorProperties = `{
+	"@timestamp":    {"type": "date"},
+	"time_original": {"type": "keyword"},
+	"time_unparsed": {"type": "boolean"},
+	"time_stamp":    {"type": "keyword"},
+	"log_level":     {"type": "keyword"},
+	"message":       {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
+	"pid":           {"type": "keyword"},
+	"tid":           {"type": "keyword"},
+	"connection_id": {"type": "keyword"},
+	"client":        {"type": "ip", "ignore_malformed": true},
+	"server":        {"type": "keyword"},
+	"request":       {"type": "keyword", "ignore_above": 2048},
+	"upstream":      {"type": "keyword", "ignore_above": 2048},
+	"host":          {"type": "keyword"},
+	"referrer":      {"type": "keyword", "ignore_above": 2048}
+}`
+
+const phpErrorProperties = `{
+	"@timestamp":    {"type": "date"},
+	"time_original": {"type": "keyword"},
+	"time_unparsed": {"type": "boolean"},
+	"time_stamp":    {"type": "keyword"},
+	"log_level":     {"type": "keyword"},
+	"message":       {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
+	"pool":          {"type": "keyword"},
+	"pid":           {"type": "keyword"},
+	"exit_code":     {"type": "keyword"},
+	"signal":        {"type": "keyword"},
+	"type":          {"type": "keyword"},
+	"file":          {"type": "keyword"},
+	"line":          {"type": "long", "ignore_malformed": true},
+	"stack":         {"type": "text"}
+}`
+
+// Elasticsearch flavours selectable by ES_ENGINE.
+const (
+	engineV6         = "v6" // Elasticsearch 6 (olivere/elastic.v6, mapping types)
+	engineV7         = "v7" // Elasticsearch 7 (typeless)
+	engineV8         = "v8" // Elasticsearch 8 (typeless, composable templates)
+	engineOpenSearch = "opensearch"
+)
+
+// esEngine returns the Elasticsearch flavour of ES_URL.
+func esEngine() string {
+	return getenv("ES_ENGINE", engineV6)
+}
+
+// esDoc is one document to be indexed.
+type esDoc struct {
+	Id    string      // document id, empty to let Elasticsearch choose
+	Index string      // index name or write alias
+	Type  string      // mapping type (Elasticsearch 6 only)
+	Body  interface{} // document source
+}
+
+// esSink indexes documents into Elasticsearch or OpenSearch.
+type esSink interface {
+	Index(ctx context.Context, docs []esDoc) error
+}
+
+// newESSink returns the sink for ES_ENGINE. Tests replace it with a sink
+// of a fake endpoint.
+var newESSink = func() (esSink, error) {
+	switch esEngine() {
+	case engineV6:
+		cli, err := elasticClient()
+		if err != nil {
+			return nil, err
+		}
+		return &v6Sink{cli: cli}, nil
+	case engineV7, engineV8, engineOpenSearch:
+		cli, err := signedClient()
+		if err != nil {
+			return nil, err
+		}
+		return &bulkSink{cli: cli, url: esURL()}, nil
+	}
+	return nil, errors.Errorf("Error unknown ES_ENGINE %q", esEngine())
+}
+
+// signedClient returns a http client signing requests with SigV4.
+func signedClient() (*http.Client, error) {
+	creds := credentials.NewEnvCredentials()
+	signer := v4.NewSigner(creds)
+
+	return aws_signing_client.New(signer, nil, "es", os.Getenv("REGION"))
+}
+
+func elasticClient() (*elastic.Client, error) {
+
+	awsClient, err := signedClient()
+	if err != nil {
+		return nil, err
+	}
+	return elastic.NewClient(
+		elastic.SetURL(os.Getenv("ES_URL")),
+		elastic.SetScheme("https"),
+		elastic.SetHttpClient(awsClient),
+		elastic.SetSniff(false),
+	)
+}
+
+// esURL returns ES_URL with https as default scheme.
+func esURL() string {
+	u := strings.TrimSuffix(os.Getenv("ES_URL"), "/")
+	if !strings.Contains(u, "://") {
+		u = "https://" + u
+	}
+	return u
+}
+
+// v6Sink indexes documents one by one with olivere/elastic.v6.
+type v6Sink struct {
+	cli *elastic.Client
+}
+
+func (s *v6Sink) Index(ctx context.Context, docs []esDoc) error {
+	for _, d := range docs {
+		service := s.cli.Index().Index(d.Index).Type(d.Type)
+		if d.Id != "" {
+			service = service.Id(d.Id)
+		}
+		_, err := service.BodyJson(d.Body).Do(ctx)
+		if err != nil {
+			return errors.Wrap(err, "Error failed to elasticsearch PUT")
+		}
+	}
+	return nil
+}
+
+// Limits of one _bulk request. Elasticsearch rejects bodies larger than
+// http.max_content_length (100mb by default); smaller requests are also
+// indexed faster.
+const (
+	bulkMaxDocs  = 1000
+	bulkMaxBytes = 5 * 1024 * 1024
+)
+
+// bulkSink indexes documents with typeless _bulk requests, which are
+// understood by Elasticsearch 7/8 and OpenSearch. The documents are sent
+// in chunks of up to maxDocs documents and maxBytes bytes (bulkMaxDocs and
+// bulkMaxBytes if zero); a document larger than maxBytes is sent alone.
+type bulkSink struct {
+	cli      *http.Client
+	url      string
+	maxDocs  int
+	maxBytes int
+}
+
+// bulkResponse is the part of the _bulk response needed to find failures.
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Index  string `json:"_index"`
+		Status int    `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+func (s *bulkSink) Index(ctx context.Context, docs []esDoc) error {
+	maxDocs, maxBytes := s.maxDocs, s.maxBytes
+	if maxDocs <= 0 {
+		maxDocs = bulkMaxDocs
+	}
+	if maxBytes <= 0 {
+		maxBytes = bulkMaxBytes
+	}
+
+	var body bytes.Buffer
+	n := 0
+	for _, d := range docs {
+		action := map[string]map[string]string{"index": {"_index": d.Index}}
+		if d.Id != "" {
+			action["index"]["_id"] = d.Id
+		}
+		a, err := json.Marshal(action)
+		if err != nil {
+			return errors.Wrap(err, "Error failed to create bulk request")
+		}
+		b, err := json.Marshal(d.Body)
+		if err != nil {
+			return errors.Wrap(err, "Error failed to create bulk request")
+		}
+
+		if n > 0 && (n == maxDocs || body.Len()+len(a)+len(b)+2 > maxBytes) {
+			if err := s.bulk(ctx, body.Bytes(), n); err != nil {
+				return err
+			}
+			body.Reset()
+			n = 0
+		}
+		body.Write(a)
+		body.WriteByte('\n')
+		body.Write(b)
+		body.WriteByte('\n')
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	return s.bulk(ctx, body.Bytes(), n)
+}
+
+// bulk sends one _bulk request of n documents.
+func (s *bulkSink) bulk(ctx context.Context, body []byte, n int) error {
+	status, res, err := esRequest(ctx, s.cli, s.url, "POST", "/_bulk", body)
+	if err != nil {
+		return errors.Wrap(err, "Error failed to elasticsearch bulk")
+	}
+	if status >= 300 {
+		return errors.Errorf("Error failed to elasticsearch bulk: %d %s", status, res)
+	}
+
+	var r bulkResponse
+	if err := json.Unmarshal(res, &r); err != nil {
+		return errors.Wrap(err, "Error failed to read bulk response")
+	}
+	if !r.Errors {
+		return nil
+	}
+
+	failed := 0
+	var reason string
+	for _, item := range r.Items {
+		for _, result := range item {
+			if result.Status >= 300 {
+				failed++
+				if reason == "" {
+					reason = fmt.Sprintf("%s: %s %s", result.Index, result.Error.Type, result.Error.Reason)
+				}
+			}
+		}
+	}
+	return errors.Errorf("Error failed to elasticsearch bulk: %d of %d documents (%s)", failed, n, reason)
+}
+
+// esRequest sends a request to Elasticsearch and returns the status code
+// and the response body.
+func esRequest(ctx context.Context, cli *http.Client, url string, method string, path string, body []byte) (int, []byte, error) {
+	req, err := http.NewRequest(method, url+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req = req.WithContext(ctx)
+	if strings.HasSuffix(path, "/_bulk") {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := cli.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	res, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, res, err
+}
+
+// kinesisID identifies the record by shard and sequence number.
+func kinesisID(record events.KinesisEventRecord) string {
+	if record.EventID != "" {
+		return record.EventID
+	}
+	return record.Kinesis.SequenceNumber
+}
+
+// docID returns the Elasticsearch _id of a record, so that a retried
+// batch overwrites the documents instead of duplicating them.
+func docID(id string, v interface{}) string {
+	if id == "" || os.Getenv("ES_DOC_ID") == "content" {
+		return contentID(v)
+	}
+	return id
+}
+
+// contentID derives a document id from the document itself, for records
+// without a Kinesis sequence number.
+func contentID(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return fmt.Sprintf("%x", sha1.Sum(b))
+}
+
+// getenv returns the environment variable or def when it is empty.
+func getenv(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// ilmPolicyName is the ILM policy shared by every log index.
+func ilmPolicyName() string {
+	return getenv("ES_ILM_POLICY", "log-aggregation")
+}
+
+// isIndexPattern reports whether the index is a time-based name pattern
+// such as nginx-access-%Y.%m.%d rather than a write alias.
+func isIndexPattern(index string) bool {
+	return strings.Contains(index, "%")
+}
+
+// indexName expands %Y, %m, %d and %H in the pattern with the (UTC) time
+// of the record.
+func indexName(pattern string, t time.Time) string {
+	if !isIndexPattern(pattern) {
+		return pattern
+	}
+	t = t.UTC()
+	r := strings.NewReplacer(
+		"%Y", t.Format("2006"),
+		"%m", t.Format("01"),
+		"%d", t.Format("02"),
+		"%H", t.Format("15"),
+		"%%", "%",
+	)
+	return r.Replace(pattern)
+}
+
+// ilmPolicy rolls the write index over daily (or by size) and deletes
+// indices after the retention period. Time-based indices are not rolled
+// over, so their policy only has the delete phase.
+// OpenSearch has ISM instead of ILM; its policy attaches itself to the
+// indices matching patterns.
+func ilmPolicy(rollover bool, patterns []string) ([]byte, error) {
+	if esEngine() == engineOpenSearch {
+		return ismPolicy(rollover, patterns)
+	}
+
+	phases := map[string]interface{}{
+		"delete": map[string]interface{}{
+			"min_age": getenv("ES_RETENTION", "30d"),
+			"actions": map[string]interface{}{
+				"delete": map[string]interface{}{},
+			},
+		},
+	}
+	if rollover {
+		phases["hot"] = map[string]interface{}{
+			"actions": map[string]interface{}{
+				"rollover": map[string]string{
+					"max_age":  getenv("ES_ROLLOVER_MAX_AGE", "1d"),
+					"max_size": getenv("ES_ROLLOVER_MAX_SIZE", "50gb"),
+				},
+			},
+		}
+	}
+	return json.Marshal(map[string]interface{}{
+		"policy": map[string]interface{}{
+			"phases": phases,
+		},
+	})
+}
+
+func ismPolicy(rollover bool, patterns []string) ([]byte, error) {
+	hotActions := []interface{}{}
+	if rollover {
+		hotActions = append(hotActions, map[string]interface{}{
+			"rollover": map[string]string{
+				"min_index_age": getenv("ES_ROLLOVER_MAX_AGE", "1d"),
+				"min_size":      getenv("ES_ROLLOVER_MAX_SIZE", "50gb"),
+			},
+		})
+	}
+
+	policy := map[string]interface{}{
+		"description":   "log-aggregation retention",
+		"default_state": "hot",
+		"states": []interface{}{
+			map[string]interface{}{
+				"name":    "hot",
+				"actions": hotActions,
+				"transitions": []interface{}{
+					map[string]interface{}{
+						"state_name": "delete",
+						"conditions": map[string]string{"min_index_age": getenv("ES_RETENTION", "30d")},
+					},
+				},
+			},
+			map[string]interface{}{
+				"name":        "delete",
+				"actions":     []interface{}{map[string]interface{}{"delete": map[string]interface{}{}}},
+				"transitions": []interface{}{},
+			},
+		},
+	}
+	if len(patterns) > 0 {
+		policy["ism_template"] = map[string]interface{}{"index_patterns": patterns}
+	}
+	return json.Marshal(map[string]interface{}{"policy": policy})
+}
+
+// policyPath is the API path of the lifecycle policy.
+func policyPath(name string) string {
+	if esEngine() == engineOpenSearch {
+		return "/_plugins/_ism/policies/" + name
+	}
+	return "/_ilm/policy/" + name
+}
+
+// dailyPolicyName is the delete only policy of time-based indices.
+func dailyPolicyName() string {
+	return ilmPolicyName() + "-daily"
+}
+
+// templatePath is the API path of the index template. Elasticsearch 8
+// and OpenSearch use composable templates.
+func templatePath(name string) string {
+	switch esEngine() {
+	case engineV8, engineOpenSearch:
+		return "/_index_template/" + name
+	}
+	return "/_template/" + name
+}
+
+// indexPattern returns the pattern of the indices behind the write alias
+// or created from the time-based index name.
+func indexPattern(index string) string {
+	if isIndexPattern(index) {
+		return index[:strings.Index(index, "%")] + "*"
+	}
+	return index + "-*"
+}
+
+// body renders the index template for the write alias or index pattern.
+// New indices matching the pattern get the mapping automatically.
+func (t esTemplate) body(index string) ([]byte, error) {
+	raw := []byte(t.Properties)
+	if file := os.Getenv(t.MappingEnv); file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error failed to read "+t.MappingEnv)
+		}
+		raw = b
+	}
+
+	var properties json.RawMessage
+	if err := json.Unmarshal(raw, &properties); err != nil {
+		return nil, err
+	}
+
+	settings := map[string]string{}
+	switch {
+	case esEngine() == engineOpenSearch && !isIndexPattern(index):
+		settings["plugins.index_state_management.rollover_alias"] = index
+	case esEngine() == engineOpenSearch:
+		// the ISM policy attaches itself by ism_template.
+	case isIndexPattern(index):
+		settings["index.lifecycle.name"] = dailyPolicyName()
+	default:
+		settings["index.lifecycle.name"] = ilmPolicyName()
+		settings["index.lifecycle.rollover_alias"] = index
+	}
+
+	var mappings interface{} = map[string]interface{}{
+		"properties": properties,
+	}
+	if esEngine() == engineV6 {
+		mappings = map[string]interface{}{
+			getenv(t.TypeEnv, "_doc"): mappings,
+		}
+	}
+
+	template := map[string]interface{}{
+		"index_patterns": []string{indexPattern(index)},
+		"version":        templateVersion,
+	}
+	switch esEngine() {
+	case engineV8, engineOpenSearch:
+		template["template"] = map[string]interface{}{
+			"settings": settings,
+			"mappings": mappings,
+		}
+	default:
+		template["settings"] = settings
+		template["mappings"] = mappings
+	}
+	return json.Marshal(template)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// nginx error_log line, e.g.
+// 2019/08/23 15:37:26 [error] 123#0: *45 upstream timed out ..., client: 1.2.3.4, server: x, request: "GET / HTTP/1.1", upstream: "...", host: "..."
+var (
+	nginxErrorLinePattern    = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}) \[(\w+)\] (?s)(.*)$`)
+	nginxErrorMessagePattern = regexp.MustCompile(`^(?s)(?:(\d+)#(\d+): )?(?:\*(\d+) )?(.*)$`)
+	nginxErrorContextPattern = regexp.MustCompile(`, (client|server|request|upstream|host|referrer): ("(?:[^"\\]|\\.)*"|[^,]*)`)
+)
+
+// isNginxErrorLine reports whether data is a raw nginx error_log line.
+func isNginxErrorLine(data []byte) bool {
+	return nginxErrorLinePattern.Match(data)
+}
+
+// parseNginxErrorLine parses a raw nginx error_log line.
+func parseNginxErrorLine(data []byte) (NginxError, bool) {
+	m := nginxErrorLinePattern.FindSubmatch(data)
+	if m == nil {
+		return NginxError{}, false
+	}
+
+	e := NginxError{
+		Logname:   "nginx_error",
+		Timestamp: string(m[1]),
+		Loglevel:  string(m[2]),
+		Message:   strings.TrimSpace(string(m[3])),
+	}
+	parseNginxErrorMessage(&e)
+	return e, true
+}
+
+// parseNginxErrorMessage moves pid, tid, connection id and the request
+// context (client, server, request, upstream, host) out of the message.
+func parseNginxErrorMessage(e *NginxError) {
+	m := nginxErrorMessagePattern.FindStringSubmatch(e.Message)
+	if m == nil {
+		return
+	}
+	e.Pid, e.Tid, e.Connection = m[1], m[2], m[3]
+	message := m[4]
+
+	fields := nginxErrorContextPattern.FindAllStringSubmatchIndex(message, -1)
+	if fields == nil {
+		e.Message = message
+		return
+	}
+	for _, c := range fields {
+		key := message[c[2]:c[3]]
+		value := message[c[4]:c[5]]
+		if s, err := strconv.Unquote(value); err == nil {
+			value = s
+		}
+		switch key {
+		case "client":
+			e.Client = value
+		case "server":
+			e.Server = value
+		case "request":
+			e.Request = value
+		case "upstream":
+			e.Upstream = value
+		case "host":
+			e.Host = value
+		case "referrer":
+			e.Referrer = value
+		}
+	}
+	e.Message = message[:fields[0][0]]
+}
+
+// alertMessage is the slack notification of the nginx error.
+func (e NginxError) alertMessage() string {
+	message := e.Message
+	for _, kv := range [][2]string{
+		{"host", e.Host},
+		{"upstream", e.Upstream},
+		{"request", e.Request},
+		{"client", e.Client},
+	} {
+		if kv[1] != "" {
+			message += "\n" + kv[0] + ": " + kv[1]
+		}
+	}
+	return message
+}
+
+// php-fpm log line, e.g.
+// [23-Aug-2019 15:37:26] WARNING: [pool www] child 123 exited with code 255 after 1.234 seconds from start
+// and PHP error log line, e.g.
+// [23-Aug-2019 06:37:26 UTC] PHP Fatal error:  Uncaught Exception: boom in /var/www/app.php:12
+// The zone is an abbreviation or the date.timezone name (Asia/Tokyo).
+var (
+	phpErrorLinePattern  = regexp.MustCompile(`^\[(\d{2}-\w{3}-\d{4} \d{2}:\d{2}:\d{2}(?:\.\d+)?(?: [\w/+-]+)?)\] (?s)(.*)$`)
+	phpFpmMessagePattern = regexp.MustCompile(`^(?s)(DEBUG|NOTICE|WARNING|ERROR|ALERT): (?:\[pool ([^\]]+)\] )?(.*)$`)
+	phpMessagePattern    = regexp.MustCompile(`^(?s)PHP ([A-Za-z ]+?):\s+(.*)$`)
+	phpChildPattern      = regexp.MustCompile(`child (\d+)`)
+	phpExitCodePattern   = regexp.MustCompile(`exited with code (\d+)`)
+	phpSignalPattern     = regexp.MustCompile(`exited on signal (\d+)(?: \((\w+)\))?`)
+	phpFilePattern       = regexp.MustCompile(` in (/\S+?)(?::(\d+)| on line (\d+))`)
+	phpStackPattern      = regexp.MustCompile(`^(?:PHP )?(?:Stack trace:|\s*#\d+ |\s+\d+\. |\s*thrown in |\s*\{main\})`)
+)
+
+// phpErrorLevels maps the PHP error type to the php-fpm log level.
+var phpErrorLevels = map[string]string{
+	"Fatal error":             "ERROR",
+	"Parse error":             "ERROR",
+	"Recoverable fatal error": "ERROR",
+	"Warning":                 "WARNING",
+	"Notice":                  "NOTICE",
+	"Deprecated":              "NOTICE",
+	"Strict Standards":        "NOTICE",
+}
+
+// isPhpErrorLine reports whether data is a raw php-fpm or PHP error log line.
+func isPhpErrorLine(data []byte) bool {
+	return phpErrorLinePattern.Match(data)
+}
+
+// parsePhpErrorLine parses a raw php-fpm or PHP error log line.
+func parsePhpErrorLine(data []byte) (PhpError, bool) {
+	m := phpErrorLinePattern.FindSubmatch(data)
+	if m == nil {
+		return PhpError{}, false
+	}
+
+	e := PhpError{
+		Logname:   "php-fpm-error",
+		Timestamp: string(m[1]),
+		Message:   strings.TrimSpace(string(m[2])),
+	}
+	parsePhpErrorMessage(&e)
+	return e, true
+}
+
+// parsePhpErrorMessage splits pool, child pid, exit code or signal, and the
+// PHP error type with its file and line out of the message.
+func parsePhpErrorMessage(e *PhpError) {
+	if m := phpFpmMessagePattern.FindStringSubmatch(e.Message); m != nil {
+		e.Loglevel, e.Pool, e.Message = m[1], m[2], m[3]
+	}
+
+	if m := phpMessagePattern.FindStringSubmatch(e.Message); m != nil {
+		e.Type = m[1]
+		if level, ok := phpErrorLevels[m[1]]; ok && e.Loglevel == "" {
+			e.Loglevel = level
+		}
+		e.Message = m[2]
+		if f := phpFilePattern.FindStringSubmatch(e.Message); f != nil {
+			e.File = f[1]
+			e.Line = f[2] + f[3]
+		}
+	}
+
+	if e.Pool != "" {
+		if m := phpChildPattern.FindStringSubmatch(e.Message); m != nil {
+			e.Pid = m[1]
+		}
+		if m := phpExitCodePattern.FindStringSubmatch(e.Message); m != nil {
+			e.ExitCode = m[1]
+		}
+		if m := phpSignalPattern.FindStringSubmatch(e.Message); m != nil {
+			e.Signal = m[1]
+			if m[2] != "" {
+				e.Signal = m[2]
+			}
+		}
+	}
+}
+
+// isPhpContinuation reports whether the message is a stack trace line of
+// the previous record.
+func isPhpContinuation(message string) bool {
+	return phpStackPattern.MatchString(message)
+}
+
+// appendStack adds a continuation line to the stack of the record.
+func (e *PhpError) appendStack(line string) {
+	line = strings.TrimSpace(strings.TrimPrefix(line, "PHP "))
+	if line == "" || line == "Stack trace:" {
+		return
+	}
+	e.Stack = append(e.Stack, line)
+}
+
+// phpErrorJoiner stitches multi-line PHP errors, which arrive as separate
+// Kinesis records, into one record with a stack.
+type phpErrorJoiner struct {
+	records PhpErrors
+	last    map[string]int // partition key -> index of its last record
+}
+
+func newPhpErrorJoiner() *phpErrorJoiner {
+	return &phpErrorJoiner{last: map[string]int{}}
+}
+
+// add appends the record, or joins it to the previous record of the same
+// partition key and timestamp when it is a stack trace line.
+func (j *phpErrorJoiner) add(partitionKey string, e PhpError) {
+	if i, ok := j.last[partitionKey]; ok && isPhpContinuation(e.Message) && j.records[i].Timestamp == e.Timestamp {
+		j.records[i].appendStack(e.Message)
+		return
+	}
+	j.records = append(j.records, e)
+	j.last[partitionKey] = len(j.records) - 1
+}
+
+// continueLine joins a stack trace line without timestamp to the previous
+// record of the partition key. It returns false if the line is not a stack
+// trace line or there is no such record.
+func (j *phpErrorJoiner) continueLine(partitionKey string, line string) bool {
+	i, ok := j.last[partitionKey]
+	if !ok || !isPhpContinuation(line) {
+		return false
+	}
+	j.records[i].appendStack(line)
+	return true
+}
+
+// alertMessage is the slack notification of the php error, with the top
+// of the stack trace.
+func (e PhpError) alertMessage() string {
+	message := e.Message
+	if e.Pool != "" {
+		message = "[pool " + e.Pool + "] " + message
+	}
+	for i, frame := range e.Stack {
+		if i == 5 {
+			message += "\n..."
+			break
+		}
+		message += "\n" + frame
+	}
+	return message
+}
+
+// php-fpm slowlog, e.g.
+// [23-Aug-2019 15:37:26]  [pool www] pid 123
+// script_filename = /var/www/public/index.php
+// [0x00007f3b5c81e0a8] curl_exec() /var/www/app/Http/Client.php:45
+var (
+	phpSlowlogPattern       = regexp.MustCompile(`^\[(\d{2}-\w{3}-\d{4} \d{2}:\d{2}:\d{2}(?:\.\d+)?)\]\s+\[pool ([^\]]+)\] pid (\d+)\s*$`)
+	phpSlowlogScriptPattern = regexp.MustCompile(`^script_filename = (.*)$`)
+	phpSlowlogFramePattern  = regexp.MustCompile(`^\[0x[0-9a-f]+\] (.*)$`)
+	phpSlowPattern          = regexp.MustCompile(`executing too slow \(([\d.]+) sec\)`)
+)
+
+// isPhpSlowlog reports whether data starts a slowlog entry.
+func isPhpSlowlog(data []byte) bool {
+	line := data
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		line = data[:i]
+	}
+	return phpSlowlogPattern.Match(bytes.TrimSpace(line))
+}
+
+// isPhpSlowlogContinuation reports whether data is a script_filename or a
+// backtrace line of a slowlog entry.
+func isPhpSlowlogContinuation(data []byte) bool {
+	line := bytes.TrimSpace(data)
+	return phpSlowlogScriptPattern.Match(line) || phpSlowlogFramePattern.Match(line)
+}
+
+// parsePhpSlowlog parses a slowlog entry. The entry may hold only the
+// header line, or the whole entry when it was shipped as one record.
+func parsePhpSlowlog(data []byte) (PhpSlowlog, bool) {
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	m := phpSlowlogPattern.FindStringSubmatch(strings.TrimSpace(lines[0]))
+	if m == nil {
+		return PhpSlowlog{}, false
+	}
+
+	s := PhpSlowlog{
+		Logname:   "php-fpm-slowlog",
+		Timestamp: m[1],
+		Pool:      m[2],
+		Pid:       m[3],
+	}
+	for _, line := range lines[1:] {
+		s.appendLine(line)
+	}
+	return s, true
+}
+
+// appendLine adds the script_filename or a backtrace frame to the entry.
+func (s *PhpSlowlog) appendLine(line string) {
+	line = strings.TrimSpace(line)
+	if m := phpSlowlogScriptPattern.FindStringSubmatch(line); m != nil {
+		s.Script = m[1]
+	} else if m := phpSlowlogFramePattern.FindStringSubmatch(line); m != nil {
+		s.Frames = append(s.Frames, m[1])
+	}
+}
+
+// slowDuration returns the duration of the "executing too slow" warning.
+func (e PhpError) slowDuration() string {
+	if m := phpSlowPattern.FindStringSubmatch(e.Message); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// phpSlowlogJoiner stitches slowlog lines, which arrive as separate
+// Kinesis records, into one entry.
+type phpSlowlogJoiner struct {
+	records PhpSlowlogs
+	last    map[string]int // partition key -> index of its last entry
+}
+
+func newPhpSlowlogJoiner() *phpSlowlogJoiner {
+	return &phpSlowlogJoiner{last: map[string]int{}}
+}
+
+func (j *phpSlowlogJoiner) add(partitionKey string, s PhpSlowlog) {
+	j.records = append(j.records, s)
+	j.last[partitionKey] = len(j.records) - 1
+}
+
+// continueLine joins the line to the last entry of the partition key. It
+// returns false if there is no such entry.
+func (j *phpSlowlogJoiner) continueLine(partitionKey string, line string) bool {
+	i, ok := j.last[partitionKey]
+	if !ok {
+		return false
+	}
+	j.records[i].appendLine(line)
+	return true
+}
+
+// setDurations copies the duration of the "executing too slow" warning of
+// the same pool and pid to the slowlog entries.
+func (j *phpSlowlogJoiner) setDurations(phperrors PhpErrors) {
+	durations := map[string]string{}
+	for _, e := range phperrors {
+		if d := e.slowDuration(); d != "" {
+			durations[e.Pool+" "+e.Pid] = d
+		}
+	}
+	for i := range j.records {
+		if d, ok := durations[j.records[i].Pool+" "+j.records[i].Pid]; ok && j.records[i].Duration == "" {
+			j.records[i].Duration = d
+		}
+	}
+}
+
+// slowScripts returns the scripts that exceeded the threshold at least
+// count times, with the number of times.
+func slowScripts(slowlogs PhpSlowlogs, count int, seconds float64) ([]string, map[string]int) {
+	counts := map[string]int{}
+	scripts := make([]string, 0)
+	for _, s := range slowlogs {
+		if seconds > 0 {
+			d, err := strconv.ParseFloat(s.Duration, 64)
+			if err != nil || d < seconds {
+				continue
+			}
+		}
+		counts[s.Script]++
+		if counts[s.Script] == count {
+			scripts = append(scripts, s.Script)
+		}
+	}
+	return scripts, counts
+}
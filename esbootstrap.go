@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"net/http"
+	"os"
+)
+
+// esBootstrap sends the bootstrap requests to ES_URL.
+type esBootstrap struct {
+	cli *http.Client
+	url string
+}
+
+// do sends the request and treats any status but 2xx and the accepted
+// ones as an error.
+func (b *esBootstrap) do(ctx context.Context, method string, path string, body []byte, accept ...int) (int, []byte, error) {
+	status, res, err := esRequest(ctx, b.cli, b.url, method, path, body)
+	if err != nil {
+		return status, res, err
+	}
+	if status < 300 {
+		return status, res, nil
+	}
+	for _, a := range accept {
+		if status == a {
+			return status, res, nil
+		}
+	}
+	return status, res, errors.Errorf("%s %s: %d %s", method, path, status, res)
+}
+
+// putPolicy installs or updates a lifecycle policy (ILM, or ISM on
+// OpenSearch).
+func (b *esBootstrap) putPolicy(ctx context.Context, name string, rollover bool, patterns []string) error {
+	policy, err := ilmPolicy(rollover, patterns)
+	if err != nil {
+		return errors.Wrap(err, "Error failed to create lifecycle policy")
+	}
+
+	// ISM overwrites a policy only at its current sequence number.
+	path := policyPath(name)
+	if esEngine() == engineOpenSearch {
+		status, res, err := b.do(ctx, "GET", path, nil, http.StatusNotFound)
+		if err != nil {
+			return errors.Wrap(err, "Error failed to elasticsearch GET lifecycle policy")
+		}
+		if status == http.StatusOK {
+			var current struct {
+				SeqNo       *int64 `json:"_seq_no"`
+				PrimaryTerm *int64 `json:"_primary_term"`
+			}
+			if err := json.Unmarshal(res, &current); err != nil || current.SeqNo == nil || current.PrimaryTerm == nil {
+				return errors.Errorf("Error no sequence number in lifecycle policy %s: %s", name, res)
+			}
+			path += fmt.Sprintf("?if_seq_no=%d&if_primary_term=%d", *current.SeqNo, *current.PrimaryTerm)
+		}
+	}
+
+	_, _, err = b.do(ctx, "PUT", path, policy)
+	if err != nil {
+		return errors.Wrap(err, "Error failed to elasticsearch PUT lifecycle policy")
+	}
+	fmt.Println("put lifecycle policy", name)
+	return nil
+}
+
+// installedVersion returns the version of the installed template, or 0.
+func (b *esBootstrap) installedVersion(ctx context.Context, name string) (int, error) {
+	status, res, err := b.do(ctx, "GET", templatePath(name), nil, http.StatusNotFound)
+	if err != nil || status == http.StatusNotFound {
+		return 0, err
+	}
+
+	// legacy templates: {"name": {"version": 1}}
+	// composable templates: {"index_templates": [{"index_template": {"version": 1}}]}
+	var composable struct {
+		IndexTemplates []struct {
+			IndexTemplate struct {
+				Version int `json:"version"`
+			} `json:"index_template"`
+		} `json:"index_templates"`
+	}
+	if json.Unmarshal(res, &composable) == nil && len(composable.IndexTemplates) > 0 {
+		return composable.IndexTemplates[0].IndexTemplate.Version, nil
+	}
+
+	var legacy map[string]struct {
+		Version int `json:"version"`
+	}
+	json.Unmarshal(res, &legacy)
+	return legacy[name].Version, nil
+}
+
+// putTemplate installs the index template unless a newer version exists.
+func (b *esBootstrap) putTemplate(ctx context.Context, t esTemplate, index string) error {
+	version, err := b.installedVersion(ctx, t.Name)
+	if err != nil {
+		return errors.Wrap(err, "Error failed to elasticsearch GET template")
+	}
+	if version > templateVersion {
+		fmt.Printf("skip template %s (installed version %d > %d)\n", t.Name, version, templateVersion)
+		return nil
+	}
+
+	body, err := t.body(index)
+	if err != nil {
+		return errors.Wrap(err, "Error failed to create template "+t.Name)
+	}
+
+	_, _, err = b.do(ctx, "PUT", templatePath(t.Name), body)
+	if err != nil {
+		return errors.Wrap(err, "Error failed to elasticsearch PUT template "+t.Name)
+	}
+	fmt.Println("put template", t.Name, "version", templateVersion)
+	return nil
+}
+
+// createWriteIndex creates the first index behind the alias, so that
+// rollover has something to roll.
+func (b *esBootstrap) createWriteIndex(ctx context.Context, alias string) error {
+	status, _, err := b.do(ctx, "HEAD", "/_alias/"+alias, nil, http.StatusNotFound)
+	if err != nil {
+		return errors.Wrap(err, "Error failed to elasticsearch HEAD alias")
+	}
+	if status == http.StatusOK {
+		fmt.Println("alias exists", alias)
+		return nil
+	}
+
+	// an index written before the alias (e.g. by the v6 sink) has its
+	// name, and an alias cannot be created over it.
+	status, _, err = b.do(ctx, "HEAD", "/"+alias, nil, http.StatusNotFound)
+	if err != nil {
+		return errors.Wrap(err, "Error failed to elasticsearch HEAD index")
+	}
+	if status == http.StatusOK {
+		return errors.Errorf("Error %s is an index, not an alias: reindex it into %s-000001 and delete it, then run esbootstrap again", alias, alias)
+	}
+
+	body := fmt.Sprintf(`{"aliases": {"%s": {"is_write_index": true}}}`, alias)
+	_, _, err = b.do(ctx, "PUT", "/"+alias+"-000001", []byte(body))
+	if err != nil {
+		return errors.Wrap(err, "Error failed to elasticsearch PUT index "+alias+"-000001")
+	}
+	fmt.Println("create index", alias+"-000001")
+	return nil
+}
+
+// bootstrap installs the lifecycle policies, the index templates and the
+// write aliases. It is safe to run again after a template change.
+func (b *esBootstrap) bootstrap(ctx context.Context) error {
+	var aliasPatterns, dailyPatterns []string
+	for _, t := range esTemplates {
+		index := os.Getenv(t.AliasEnv)
+		switch {
+		case index == "":
+		case isIndexPattern(index):
+			dailyPatterns = append(dailyPatterns, indexPattern(index))
+		default:
+			aliasPatterns = append(aliasPatterns, indexPattern(index))
+		}
+	}
+
+	if err := b.putPolicy(ctx, ilmPolicyName(), true, aliasPatterns); err != nil {
+		return err
+	}
+	if err := b.putPolicy(ctx, dailyPolicyName(), false, dailyPatterns); err != nil {
+		return err
+	}
+
+	for _, t := range esTemplates {
+		index := os.Getenv(t.AliasEnv)
+		if index == "" {
+			fmt.Printf("skip template %s (%s is not set)\n", t.Name, t.AliasEnv)
+			continue
+		}
+		if err := b.putTemplate(ctx, t, index); err != nil {
+			return err
+		}
+
+		// time-based indices are created by the first document of the day.
+		if isIndexPattern(index) {
+			continue
+		}
+		if err := b.createWriteIndex(ctx, index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	cli, err := signedClient()
+	if err != nil {
+		fmt.Println(errors.Wrap(err, "Error failed to elasticsearch access"))
+		os.Exit(1)
+	}
+
+	b := &esBootstrap{cli: cli, url: esURL()}
+	if err := b.bootstrap(context.Background()); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
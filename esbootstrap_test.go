@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeCluster keeps the templates, policies and indices that bootstrap
+// installs, and records its requests.
+type fakeCluster struct {
+	requests  []string
+	templates map[string]int   // name -> version
+	policies  map[string]int64 // name -> ISM sequence number
+	aliases   map[string]bool
+	indices   map[string]bool
+}
+
+func newFakeCluster() (*fakeCluster, *httptest.Server) {
+	c := &fakeCluster{templates: map[string]int{}, policies: map[string]int64{}, aliases: map[string]bool{}, indices: map[string]bool{}}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := r.Method + " " + r.URL.Path
+		if r.URL.RawQuery != "" {
+			request += "?" + r.URL.RawQuery
+		}
+		c.requests = append(c.requests, request)
+		body, _ := ioutil.ReadAll(r.Body)
+
+		path := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		switch {
+		case path[0] == "_template" || path[0] == "_index_template":
+			c.template(w, r.Method, path[0], path[1], body)
+		case path[0] == "_ilm":
+			w.Write([]byte(`{"acknowledged":true}`))
+		case path[0] == "_plugins":
+			c.ismPolicy(w, r, path[3])
+		case path[0] == "_alias":
+			if !c.aliases[path[1]] {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case r.Method == "HEAD" && len(path) == 1:
+			if !c.indices[path[0]] && !c.aliases[path[0]] {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case r.Method == "PUT" && len(path) == 1:
+			var index struct {
+				Aliases map[string]interface{} `json:"aliases"`
+			}
+			json.Unmarshal(body, &index)
+			for alias := range index.Aliases {
+				if c.aliases[alias] || c.indices[alias] {
+					// invalid_alias_name_exception
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				c.aliases[alias] = true
+			}
+			c.indices[path[0]] = true
+			w.Write([]byte(`{"acknowledged":true}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	return c, ts
+}
+
+func (c *fakeCluster) template(w http.ResponseWriter, method string, kind string, name string, body []byte) {
+	if method == "PUT" {
+		var t struct {
+			Version int `json:"version"`
+		}
+		json.Unmarshal(body, &t)
+		c.templates[name] = t.Version
+		w.Write([]byte(`{"acknowledged":true}`))
+		return
+	}
+	version, ok := c.templates[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if kind == "_index_template" {
+		fmt.Fprintf(w, `{"index_templates":[{"name":%q,"index_template":{"version":%d}}]}`, name, version)
+		return
+	}
+	fmt.Fprintf(w, `{%q:{"version":%d}}`, name, version)
+}
+
+// ismPolicy refuses to overwrite a policy without its current sequence
+// number, as OpenSearch does.
+func (c *fakeCluster) ismPolicy(w http.ResponseWriter, r *http.Request, name string) {
+	seqNo, ok := c.policies[name]
+	if r.Method == "GET" {
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"_id":%q,"_version":%d,"_seq_no":%d,"_primary_term":1,"policy":{}}`, name, seqNo+1, seqNo)
+		return
+	}
+	if ok && r.URL.Query().Get("if_seq_no") != fmt.Sprint(seqNo) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if ok {
+		seqNo++
+	}
+	c.policies[name] = seqNo
+	w.Write([]byte(`{"_id":"` + name + `"}`))
+}
+
+func TestBootstrap(t *testing.T) {
+	os.Setenv("ES_NGINX_INDEX", "nginx-access")
+	os.Setenv("ES_APP_INDEX", "application-%Y.%m.%d")
+	defer os.Unsetenv("ES_NGINX_INDEX")
+	defer os.Unsetenv("ES_APP_INDEX")
+	defer os.Unsetenv("ES_ENGINE")
+
+	t.Run("elasticsearch", func(t *testing.T) {
+		os.Setenv("ES_ENGINE", "v7")
+		c, ts := newFakeCluster()
+		defer ts.Close()
+		b := &esBootstrap{cli: ts.Client(), url: ts.URL}
+
+		if err := b.bootstrap(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{
+			"PUT /_ilm/policy/log-aggregation",
+			"PUT /_ilm/policy/log-aggregation-daily",
+			"GET /_template/nginx_access",
+			"PUT /_template/nginx_access",
+			"HEAD /_alias/nginx-access",
+			"HEAD /nginx-access",
+			"PUT /nginx-access-000001",
+			"GET /_template/application",
+			"PUT /_template/application",
+		}
+		if !reflect.DeepEqual(c.requests, want) {
+			t.Errorf("got: %q\nwant: %q", c.requests, want)
+		}
+
+		// a rerun updates the policies and templates and keeps the index.
+		c.requests = nil
+		if err := b.bootstrap(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		want = []string{
+			"PUT /_ilm/policy/log-aggregation",
+			"PUT /_ilm/policy/log-aggregation-daily",
+			"GET /_template/nginx_access",
+			"PUT /_template/nginx_access",
+			"HEAD /_alias/nginx-access",
+			"GET /_template/application",
+			"PUT /_template/application",
+		}
+		if !reflect.DeepEqual(c.requests, want) {
+			t.Errorf("got: %q\nwant: %q", c.requests, want)
+		}
+	})
+
+	t.Run("index with the alias name", func(t *testing.T) {
+		os.Setenv("ES_ENGINE", "v7")
+		c, ts := newFakeCluster()
+		defer ts.Close()
+		b := &esBootstrap{cli: ts.Client(), url: ts.URL}
+		c.indices["nginx-access"] = true
+
+		err := b.bootstrap(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "nginx-access is an index") {
+			t.Errorf("got: %v\nwant: nginx-access is an index", err)
+		}
+		for _, r := range c.requests {
+			if r == "PUT /nginx-access-000001" {
+				t.Errorf("got: %q\nwant: no PUT of the first index", c.requests)
+			}
+		}
+	})
+
+	t.Run("newer template is kept", func(t *testing.T) {
+		os.Setenv("ES_ENGINE", "v8")
+		c, ts := newFakeCluster()
+		defer ts.Close()
+		b := &esBootstrap{cli: ts.Client(), url: ts.URL}
+		c.templates["nginx_access"] = templateVersion + 1
+
+		if err := b.bootstrap(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range c.requests {
+			if r == "PUT /_index_template/nginx_access" {
+				t.Errorf("got: %q\nwant: no PUT of the newer template", c.requests)
+			}
+		}
+		if c.templates["nginx_access"] != templateVersion+1 || c.templates["application"] != templateVersion {
+			t.Errorf("got: %v", c.templates)
+		}
+	})
+
+	t.Run("opensearch policy update", func(t *testing.T) {
+		os.Setenv("ES_ENGINE", "opensearch")
+		c, ts := newFakeCluster()
+		defer ts.Close()
+		b := &esBootstrap{cli: ts.Client(), url: ts.URL}
+
+		if err := b.bootstrap(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.bootstrap(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		var puts []string
+		for _, r := range c.requests {
+			if strings.HasPrefix(r, "PUT /_plugins/_ism/policies/log-aggregation-daily") {
+				puts = append(puts, r)
+			}
+		}
+		want := []string{
+			"PUT /_plugins/_ism/policies/log-aggregation-daily",
+			"PUT /_plugins/_ism/policies/log-aggregation-daily?if_seq_no=0&if_primary_term=1",
+		}
+		if !reflect.DeepEqual(puts, want) {
+			t.Errorf("got: %q\nwant: %q", puts, want)
+		}
+		if c.policies["log-aggregation"] != 1 || c.policies["log-aggregation-daily"] != 1 {
+			t.Errorf("got: %v\nwant: updated policies", c.policies)
+		}
+	})
+
+	t.Run("policy conflict", func(t *testing.T) {
+		os.Setenv("ES_ENGINE", "opensearch")
+		// the policy was created between the GET and the PUT.
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusConflict)
+		}))
+		defer ts.Close()
+		b := &esBootstrap{cli: ts.Client(), url: ts.URL}
+
+		if err := b.bootstrap(context.Background()); err == nil {
+			t.Error("got: nil\nwant: error")
+		}
+	})
+}
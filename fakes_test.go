@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSinks records what a handler sent to S3, Elasticsearch and Slack.
+type fakeSinks struct {
+	mu       sync.Mutex
+	objects  map[string][]byte // S3 key -> uncompressed body
+	docs     []fakeDoc
+	messages []fakeMessage
+
+	slack *httptest.Server
+	es    *httptest.Server
+	close func()
+}
+
+// fakeDoc is one document of a _bulk request.
+type fakeDoc struct {
+	Index  string                 `json:"index"`
+	Id     string                 `json:"id,omitempty"`
+	Source map[string]interface{} `json:"source"`
+}
+
+// fakeMessage is one Slack webhook payload.
+type fakeMessage struct {
+	Channel  string `json:"channel"`
+	Username string `json:"username"`
+	Text     string `json:"text"`
+}
+
+// memUploader is an in-memory S3.
+type memUploader struct {
+	sinks *fakeSinks
+}
+
+func (u memUploader) Upload(input *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	zr, err := gzip.NewReader(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	u.sinks.mu.Lock()
+	defer u.sinks.mu.Unlock()
+	u.sinks.objects[aws.StringValue(input.Key)] = b
+	return &s3manager.UploadOutput{Location: "mem://" + aws.StringValue(input.Bucket) + aws.StringValue(input.Key)}, nil
+}
+
+// newFakeSinks points the handlers to the fakes until close is called.
+// S3 stays a real endpoint when S3_ENDPOINT is set (e.g. a local MinIO).
+func newFakeSinks(t testing.TB) *fakeSinks {
+	f := &fakeSinks{objects: map[string][]byte{}}
+
+	f.slack = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m fakeMessage
+		json.NewDecoder(r.Body).Decode(&m)
+		f.mu.Lock()
+		f.messages = append(f.messages, m)
+		f.mu.Unlock()
+		w.Write([]byte("ok"))
+	}))
+
+	f.es = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" {
+			t.Errorf("got: %v %v\nwant: POST /_bulk", r.Method, r.URL.Path)
+		}
+		s := bufio.NewScanner(r.Body)
+		s.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+		f.mu.Lock()
+		for s.Scan() {
+			var action map[string]map[string]string
+			json.Unmarshal(s.Bytes(), &action)
+			if !s.Scan() {
+				break
+			}
+			d := fakeDoc{Index: action["index"]["_index"], Id: action["index"]["_id"]}
+			json.Unmarshal(s.Bytes(), &d.Source)
+			f.docs = append(f.docs, d)
+		}
+		f.mu.Unlock()
+		w.Write([]byte(`{"errors":false,"items":[]}`))
+	}))
+
+	orgUploader, orgSink := newUploader, newESSink
+	orgWebhook := os.Getenv("SLACK_WEBHOOK_URL")
+	if os.Getenv("S3_ENDPOINT") == "" {
+		newUploader = func() s3Uploader { return memUploader{f} }
+	}
+	newESSink = func() (esSink, error) {
+		return &bulkSink{cli: f.es.Client(), url: f.es.URL}, nil
+	}
+	os.Setenv("SLACK_WEBHOOK_URL", f.slack.URL)
+
+	f.close = func() {
+		newUploader, newESSink = orgUploader, orgSink
+		os.Setenv("SLACK_WEBHOOK_URL", orgWebhook)
+		f.slack.Close()
+		f.es.Close()
+	}
+	return f
+}
+
+// keys returns the S3 keys in order.
+func (f *fakeSinks) keys() []string {
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonLines decodes an S3 object. A line that is not JSON is kept as a
+// string, so that a golden file shows it.
+func jsonLines(b []byte) []interface{} {
+	var lines []interface{}
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		var v interface{}
+		if err := json.Unmarshal(line, &v); err != nil {
+			v = string(line)
+		}
+		lines = append(lines, v)
+	}
+	return lines
+}
+
+// object returns the JSON lines of the only object under the logname.
+func (f *fakeSinks) object(t *testing.T, logname string) []map[string]interface{} {
+	var lines []map[string]interface{}
+	found := 0
+	for k, b := range f.objects {
+		if !strings.HasPrefix(k, "/"+logname+"/") {
+			continue
+		}
+		found++
+		for _, line := range jsonLines(b) {
+			v, ok := line.(map[string]interface{})
+			if !ok {
+				t.Errorf("%s: not a JSON line: %v", k, line)
+			}
+			lines = append(lines, v)
+		}
+	}
+	if found != 1 {
+		t.Errorf("got: %v objects under %s\nwant: 1 (%v)", found, logname, f.keys())
+	}
+	return lines
+}
+
+// kinesisEvent wraps the records into an event of one partition key.
+func kinesisEvent(partitionKey string, records ...string) events.KinesisEvent {
+	var event events.KinesisEvent
+	for i, r := range records {
+		seq := fmt.Sprintf("4954511524349098501828006771497314458218006259324420%04d", i)
+		event.Records = append(event.Records, events.KinesisEventRecord{
+			EventID:     "shardId-000000000000:" + seq,
+			EventSource: "aws:kinesis",
+			Kinesis: events.KinesisRecord{
+				PartitionKey:   partitionKey,
+				SequenceNumber: seq,
+				Data:           []byte(r),
+			},
+		})
+	}
+	return event
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// s3KeyTime is the upload time in an S3 key, which changes every run.
+var s3KeyTime = regexp.MustCompile(`/\d{4}/\d{2}/\d{2}/\d{2}/(.*?)\d{14}-`)
+
+// golden is what a handler did with one event of testdata.
+type golden struct {
+	Error    string                   `json:"error,omitempty"`
+	S3       map[string][]interface{} `json:"s3"`
+	Docs     []fakeDoc                `json:"docs"`
+	Messages []fakeMessage            `json:"messages"`
+}
+
+// testGolden runs the handler on every <name>.json Kinesis event in dir
+// and compares the output with <name>.golden. With -update the golden
+// files are written instead.
+func testGolden(t *testing.T, dir string, handler func(context.Context, events.KinesisEvent) error) {
+	if os.Getenv("S3_ENDPOINT") != "" {
+		t.Skip("golden files are compared with the in-memory S3")
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("got: %v %v\nwant: events in %s", files, err, dir)
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		t.Run(name, func(t *testing.T) {
+			raw, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var event events.KinesisEvent
+			if err := json.Unmarshal(raw, &event); err != nil {
+				t.Fatal(err)
+			}
+
+			sinks := newFakeSinks(t)
+			defer sinks.close()
+			g := golden{S3: map[string][]interface{}{}}
+			if err := handler(context.Background(), event); err != nil {
+				g.Error = err.Error()
+			}
+			for k, b := range sinks.objects {
+				g.S3[s3KeyTime.ReplaceAllString(k, "/{time}/${1}{time}-")] = jsonLines(b)
+			}
+			g.Docs, g.Messages = sinks.docs, sinks.messages
+
+			got, err := json.MarshalIndent(g, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			path := filepath.Join(dir, name+".golden")
+			if *update {
+				if err := ioutil.WriteFile(path, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s differs (run with -update and review the diff)\ngot: %s\nwant: %s", path, got, want)
+			}
+		})
+	}
+}
+
+// fixtureRecords returns the record data of the Kinesis events matching
+// the patterns, the seed corpus of the fuzz tests.
+func fixtureRecords(tb testing.TB, patterns ...string) [][]byte {
+	var records [][]byte
+	for _, pattern := range patterns {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		for _, file := range files {
+			raw, err := ioutil.ReadFile(file)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			var event events.KinesisEvent
+			if err := json.Unmarshal(raw, &event); err != nil {
+				tb.Fatalf("%s: %v", file, err)
+			}
+			for _, r := range event.Records {
+				records = append(records, r.Kinesis.Data)
+			}
+		}
+	}
+	return records
+}
+
+// checkObjects fails unless every line of every S3 object is a JSON object.
+func (f *fakeSinks) checkObjects(t *testing.T) {
+	for k, b := range f.objects {
+		for _, line := range jsonLines(b) {
+			if _, ok := line.(map[string]interface{}); !ok {
+				t.Errorf("%s: not a JSON line: %q", k, line)
+			}
+		}
+	}
+}
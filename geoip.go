@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/oschwald/geoip2-golang"
+	"github.com/pkg/errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// IP anonymization modes selectable by IP_ANONYMIZE.
+const (
+	anonymizeOff      = "off"
+	anonymizeTruncate = "truncate" // zero the host part (IPv4 /24, IPv6 /48)
+	anonymizeHash     = "hash"     // replace with a keyed hash, so one client can still be followed
+)
+
+// defaultTrustedProxies are the private ranges of the load balancers and
+// proxies in front of nginx.
+const defaultTrustedProxies = "10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,127.0.0.0/8,169.254.0.0/16,::1/128,fc00::/7"
+
+// NginxGeo is the location of the client ip.
+type NginxGeo struct {
+	Country_code string       `json:"country_code,omitempty"`
+	Country      string       `json:"country,omitempty"`
+	City         string       `json:"city,omitempty"`
+	Location     *GeoLocation `json:"location,omitempty"`
+	Asn          uint         `json:"asn,omitempty"`
+	As_org       string       `json:"as_org,omitempty"`
+}
+
+// GeoLocation is written as an Elasticsearch geo_point.
+type GeoLocation struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// geoLookup finds the location of an ip, or returns nil.
+type geoLookup interface {
+	lookup(ip net.IP) *NginxGeo
+}
+
+// mmdbLookup reads MaxMind (GeoIP2/GeoLite2) databases.
+type mmdbLookup struct {
+	city *geoip2.Reader
+	asn  *geoip2.Reader
+}
+
+func (m *mmdbLookup) lookup(ip net.IP) *NginxGeo {
+	var g NginxGeo
+	if m.city != nil {
+		if c, err := m.city.City(ip); err == nil {
+			g.Country_code = c.Country.IsoCode
+			g.Country = c.Country.Names["en"]
+			g.City = c.City.Names["en"]
+			if c.Location.Latitude != 0 || c.Location.Longitude != 0 {
+				g.Location = &GeoLocation{Lat: c.Location.Latitude, Lon: c.Location.Longitude}
+			}
+		}
+	}
+	if m.asn != nil {
+		if a, err := m.asn.ASN(ip); err == nil {
+			g.Asn = a.AutonomousSystemNumber
+			g.As_org = a.AutonomousSystemOrganization
+		}
+	}
+	if g == (NginxGeo{}) {
+		return nil
+	}
+	return &g
+}
+
+var (
+	geoOnce sync.Once
+	geoDB   geoLookup
+)
+
+// openMMDB opens a database of the Lambda layer. A missing file only
+// disables its part of the lookup.
+func openMMDB(path string) *geoip2.Reader {
+	if path == "" || path == "off" {
+		return nil
+	}
+	r, err := geoip2.Open(path)
+	if err != nil {
+		fmt.Println("geoip database not loaded", path, err)
+		return nil
+	}
+	return r
+}
+
+// openGeoDB opens the databases once per Lambda container.
+func openGeoDB() geoLookup {
+	geoOnce.Do(func() {
+		m := &mmdbLookup{
+			city: openMMDB(getenv("GEOIP_CITY_DB", "/opt/GeoLite2-City.mmdb")),
+			asn:  openMMDB(getenv("GEOIP_ASN_DB", "/opt/GeoLite2-ASN.mmdb")),
+		}
+		if m.city != nil || m.asn != nil {
+			geoDB = m
+		}
+	})
+	return geoDB
+}
+
+// ipEnricher derives the client ip of an access log, adds its location and
+// anonymizes the ip fields.
+type ipEnricher struct {
+	trusted []*net.IPNet
+	mode    string
+	salt    []byte
+	geo     geoLookup
+}
+
+// newIPEnricher reads the TRUSTED_PROXIES, IP_ANONYMIZE and GEOIP_*
+// configuration.
+func newIPEnricher() (*ipEnricher, error) {
+	e := &ipEnricher{
+		mode: getenv("IP_ANONYMIZE", anonymizeOff),
+		salt: []byte(getenv("IP_HASH_SALT", "")),
+	}
+	switch e.mode {
+	case anonymizeOff, anonymizeTruncate, anonymizeHash:
+	default:
+		return nil, errors.Errorf("Error unknown IP_ANONYMIZE %q", e.mode)
+	}
+	// without a key every ipv4 hash can be reversed by trying them all.
+	if e.mode == anonymizeHash && len(e.salt) == 0 {
+		return nil, errors.New("Error IP_HASH_SALT is required in hash mode")
+	}
+
+	for _, v := range splitList(getenv("TRUSTED_PROXIES", defaultTrustedProxies)) {
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v += "/128"
+			} else {
+				v += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error invalid TRUSTED_PROXIES %q", v)
+		}
+		e.trusted = append(e.trusted, n)
+	}
+
+	e.geo = openGeoDB()
+	return e, nil
+}
+
+// parseHop reads one address of the proxy chain, with or without port.
+func parseHop(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+func (e *ipEnricher) isTrusted(ip net.IP) bool {
+	for _, n := range e.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP walks the X-Forwarded-For chain and remote_addr from the right
+// and returns the first address that is not a trusted proxy. Addresses
+// left of it are written by the client and cannot be trusted.
+func (e *ipEnricher) clientIP(v Nginx) net.IP {
+	hops := append(strings.Split(v.Forwardedfor, ","), v.Remote_addr)
+
+	var last net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHop(hops[i])
+		if ip == nil {
+			continue
+		}
+		if !e.isTrusted(ip) {
+			return ip
+		}
+		last = ip
+	}
+	// every hop is a proxy: the request came from inside.
+	return last
+}
+
+// anonymize returns the ip as written to the sinks.
+func (e *ipEnricher) anonymize(ip net.IP) string {
+	switch e.mode {
+	case anonymizeTruncate:
+		if v4 := ip.To4(); v4 != nil {
+			return v4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	case anonymizeHash:
+		mac := hmac.New(sha256.New, e.salt)
+		mac.Write([]byte(ip.String()))
+		return "ip:" + hex.EncodeToString(mac.Sum(nil))[:16]
+	}
+	return ip.String()
+}
+
+// anonymizeList anonymizes each address of a comma separated chain and
+// keeps anything else ("-") as it is.
+func (e *ipEnricher) anonymizeList(s string) string {
+	hops := strings.Split(s, ",")
+	for i, hop := range hops {
+		hops[i] = strings.TrimSpace(hop)
+		if ip := parseHop(hop); ip != nil {
+			hops[i] = e.anonymize(ip)
+		}
+	}
+	return strings.Join(hops, ", ")
+}
+
+// enrich sets the client ip and its location of the access log. The
+// location is looked up before the ip is anonymized.
+func (e *ipEnricher) enrich(v *Nginx) {
+	ip := e.clientIP(*v)
+	if ip == nil {
+		return
+	}
+	if e.geo != nil {
+		v.Geo = e.geo.lookup(ip)
+	}
+	v.Client_ip = e.anonymize(ip)
+
+	if e.mode != anonymizeOff {
+		v.Remote_addr = e.anonymizeList(v.Remote_addr)
+		v.Forwardedfor = e.anonymizeList(v.Forwardedfor)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Outside Lambda a handler binary replays an event from a file or stdin:
+//
+//	sendlog [-format auto|event|raw] [-partition-key key] [-out dir] [-real] [file]
+//
+// A Lambda event (an object with Records) is passed as it is. Raw input
+// is wrapped: each line is a Kinesis record, or the whole input is one
+// SNS message.
+
+// localOptions are the flags of a local run.
+type localOptions struct {
+	input        string
+	format       string
+	partitionKey string
+	out          string
+	real         bool
+}
+
+// isLambda reports whether the binary runs in the Lambda runtime.
+func isLambda() bool {
+	return os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != ""
+}
+
+func parseLocalFlags(args []string) (localOptions, error) {
+	var o localOptions
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.StringVar(&o.format, "format", "auto", "input format: auto, event (Lambda event JSON) or raw (log lines or an SNS message)")
+	fs.StringVar(&o.partitionKey, "partition-key", "local", "partition key of the Kinesis records wrapped from raw lines")
+	fs.StringVar(&o.out, "out", "", "directory for the S3 objects instead of stdout")
+	fs.BoolVar(&o.real, "real", false, "send to the S3, Elasticsearch and Slack configured by the environment")
+	if err := fs.Parse(args); err != nil {
+		return o, err
+	}
+	switch o.format {
+	case "auto", "event", "raw":
+	default:
+		return o, errors.Errorf("Error unknown format %q", o.format)
+	}
+	if fs.NArg() > 1 {
+		return o, errors.Errorf("Error too many inputs %q", fs.Args())
+	}
+	o.input = fs.Arg(0)
+	return o, nil
+}
+
+// readInput reads the file, or r when the name is empty or "-".
+func readInput(name string, r io.Reader) ([]byte, error) {
+	if name == "" || name == "-" {
+		return ioutil.ReadAll(r)
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error failed to read input")
+	}
+	return b, nil
+}
+
+// isEvent reports whether data is a Lambda event rather than raw input.
+func isEvent(data []byte, format string) bool {
+	if format != "auto" {
+		return format == "event"
+	}
+	var v struct {
+		Records json.RawMessage
+	}
+	return json.Unmarshal(data, &v) == nil && v.Records != nil
+}
+
+// kinesisInput reads a Kinesis event, or wraps every non-empty line into
+// a record of the partition key.
+func kinesisInput(data []byte, o localOptions) (events.KinesisEvent, error) {
+	var event events.KinesisEvent
+	if isEvent(data, o.format) {
+		if err := json.Unmarshal(data, &event); err != nil {
+			return event, errors.Wrap(err, "Error failed to decode kinesis event")
+		}
+		return event, nil
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for s.Scan() {
+		line := bytes.TrimRight(s.Bytes(), "\r")
+		if len(line) == 0 {
+			continue
+		}
+		seq := fmt.Sprintf("%020d", len(event.Records)+1)
+		event.Records = append(event.Records, events.KinesisEventRecord{
+			EventID:     "shardId-000000000000:" + seq,
+			EventName:   "aws:kinesis:record",
+			EventSource: "aws:kinesis",
+			Kinesis: events.KinesisRecord{
+				PartitionKey:   o.partitionKey,
+				SequenceNumber: seq,
+				Data:           append([]byte(nil), line...),
+			},
+		})
+	}
+	return event, s.Err()
+}
+
+// snsInput reads an SNS event, or wraps the whole input into one message.
+func snsInput(data []byte, o localOptions) (events.SNSEvent, error) {
+	var event events.SNSEvent
+	if isEvent(data, o.format) {
+		if err := json.Unmarshal(data, &event); err != nil {
+			return event, errors.Wrap(err, "Error failed to decode sns event")
+		}
+		return event, nil
+	}
+
+	event.Records = []events.SNSEventRecord{{
+		EventSource: "aws:sns",
+		SNS: events.SNSEntity{
+			Type:      "Notification",
+			Timestamp: time.Now().UTC(),
+			Message:   string(bytes.TrimSpace(data)),
+		},
+	}}
+	return event, nil
+}
+
+// startLocalSlack points SLACK_WEBHOOK_URL to a local server that writes
+// the payloads to w. The returned func restores it.
+func startLocalSlack(w io.Writer) (func(), error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Wrap(err, "Error failed to listen for slack")
+	}
+	go http.Serve(l, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "slack %s\n", b)
+		rw.Write([]byte("ok"))
+	}))
+
+	org := os.Getenv("SLACK_WEBHOOK_URL")
+	os.Setenv("SLACK_WEBHOOK_URL", "http://"+l.Addr().String())
+	return func() {
+		os.Setenv("SLACK_WEBHOOK_URL", org)
+		l.Close()
+	}, nil
+}
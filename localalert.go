@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"io"
+)
+
+// localLogs writes the log queries of the alert to w instead of calling
+// CloudWatch Logs, and finds no events.
+type localLogs struct {
+	w io.Writer
+}
+
+func (l localLogs) FilterLogEventsWithContext(ctx aws.Context, input *cloudwatchlogs.FilterLogEventsInput, opts ...request.Option) (*cloudwatchlogs.FilterLogEventsOutput, error) {
+	fmt.Fprintf(l.w, "logs %s %d-%d %s\n", aws.StringValue(input.LogGroupName), aws.Int64Value(input.StartTime), aws.Int64Value(input.EndTime), aws.StringValue(input.FilterPattern))
+	return &cloudwatchlogs.FilterLogEventsOutput{}, nil
+}
+
+// runSNS replays the input through an SNS handler. Slack messages and log
+// queries go to stdout, unless -real.
+func runSNS(args []string, stdin io.Reader, stdout io.Writer, handler func(context.Context, events.SNSEvent) error) error {
+	o, err := parseLocalFlags(args)
+	if err != nil {
+		return err
+	}
+	data, err := readInput(o.input, stdin)
+	if err != nil {
+		return err
+	}
+	event, err := snsInput(data, o)
+	if err != nil {
+		return err
+	}
+
+	if !o.real {
+		restore, err := startLocalSlack(stdout)
+		if err != nil {
+			return err
+		}
+		defer restore()
+
+		orgLogs := logsClient
+		defer func() { logsClient = orgLogs }()
+		logsClient = func() cloudWatchLogs { return localLogs{stdout} }
+	}
+	return handler(context.Background(), event)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// localUploader writes the S3 objects under dir as they would be stored,
+// or their JSON lines to w when dir is empty.
+type localUploader struct {
+	dir string
+	w   io.Writer
+}
+
+func (u localUploader) Upload(input *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	key := aws.StringValue(input.Key)
+	if u.dir != "" {
+		path := filepath.Join(u.dir, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, errors.Wrap(err, "failed to upload file")
+		}
+		b, err := ioutil.ReadAll(input.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to upload file")
+		}
+		if err := ioutil.WriteFile(path, b, 0644); err != nil {
+			return nil, errors.Wrap(err, "failed to upload file")
+		}
+		return &s3manager.UploadOutput{Location: "file://" + path}, nil
+	}
+
+	zr, err := gzip.NewReader(input.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to upload file")
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to upload file")
+	}
+	fmt.Fprintf(u.w, "s3 %s\n%s\n", key, b)
+	return &s3manager.UploadOutput{Location: "stdout://" + key}, nil
+}
+
+// writerSink writes the documents to w, one line per document.
+type writerSink struct {
+	w io.Writer
+}
+
+func (s writerSink) Index(ctx context.Context, docs []esDoc) error {
+	for _, d := range docs {
+		b, err := json.Marshal(d.Body)
+		if err != nil {
+			return errors.Wrap(err, "Error failed to marshal document")
+		}
+		fmt.Fprintf(s.w, "es %s %s %s\n", d.Index, d.Id, b)
+	}
+	return nil
+}
+
+// runKinesis replays the input through a Kinesis handler. S3 objects go to
+// -out or stdout, documents and Slack messages to stdout, unless -real.
+func runKinesis(args []string, stdin io.Reader, stdout io.Writer, handler func(context.Context, events.KinesisEvent) error) error {
+	o, err := parseLocalFlags(args)
+	if err != nil {
+		return err
+	}
+	data, err := readInput(o.input, stdin)
+	if err != nil {
+		return err
+	}
+	event, err := kinesisInput(data, o)
+	if err != nil {
+		return err
+	}
+
+	if !o.real {
+		restore, err := startLocalSlack(stdout)
+		if err != nil {
+			return err
+		}
+		defer restore()
+
+		orgUploader, orgSink := newUploader, newESSink
+		defer func() { newUploader, newESSink = orgUploader, orgSink }()
+		newUploader = func() s3Uploader { return localUploader{dir: o.out, w: stdout} }
+		newESSink = func() (esSink, error) { return writerSink{stdout}, nil }
+	}
+	return handler(context.Background(), event)
+}
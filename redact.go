@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Redaction modes selectable by REDACT_MODE.
+const (
+	redactMask = "mask" // replace with [REDACTED:<detector>]
+	redactHash = "hash" // replace with a keyed hash, so equal values can still be correlated
+	redactOff  = "off"
+)
+
+// redactDetectors find sensitive values in any string field.
+var redactDetectors = map[string]*regexp.Regexp{
+	"email":  regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	"jwt":    regexp.MustCompile(`eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]*`),
+	"card":   regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+	"apikey": regexp.MustCompile(`\b(?:AKIA[0-9A-Z]{16}|sk_(?:live|test)_[0-9A-Za-z]{16,}|xox[abpr]-[0-9A-Za-z-]{10,}|AIza[0-9A-Za-z_-]{35}|gh[pousr]_[0-9A-Za-z]{36})\b|(?i:bearer [0-9A-Za-z._~+/-]{16,}=*)`),
+}
+
+// defaultRedactQueryParams are the query-string parameters masked by default.
+const defaultRedactQueryParams = "token,access_token,refresh_token,password,passwd,api_key,apikey,key,secret,email,card_number"
+
+// redactor masks sensitive data in every string of a record before the
+// record is sent to any sink.
+type redactor struct {
+	mode      string
+	salt      []byte
+	allow     map[string]bool // fields never touched
+	deny      map[string]bool // fields always replaced as a whole
+	detectors []string
+	query     *regexp.Regexp // query-string parameters to mask
+}
+
+// splitList splits a comma separated environment variable.
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func toSet(list []string) map[string]bool {
+	set := map[string]bool{}
+	for _, v := range list {
+		set[strings.ToLower(v)] = true
+	}
+	return set
+}
+
+// newRedactor reads the REDACT_* configuration.
+func newRedactor() (*redactor, error) {
+	r := &redactor{
+		mode:  getenv("REDACT_MODE", redactMask),
+		salt:  []byte(getenv("REDACT_SALT", "")),
+		allow: toSet(splitList(getenv("REDACT_ALLOW_FIELDS", "time,datetime,time_stamp,@timestamp,time_original"))),
+		deny:  toSet(splitList(getenv("REDACT_DENY_FIELDS", ""))),
+	}
+	switch r.mode {
+	case redactMask, redactHash, redactOff:
+	default:
+		return nil, errors.Errorf("Error unknown REDACT_MODE %q", r.mode)
+	}
+	// without a key the hashes of short values can be brute-forced.
+	if r.mode == redactHash && len(r.salt) == 0 {
+		return nil, errors.New("Error REDACT_SALT is required in hash mode")
+	}
+
+	r.detectors = splitList(getenv("REDACT_DETECTORS", "email,jwt,card,apikey"))
+	for _, d := range r.detectors {
+		if _, ok := redactDetectors[d]; !ok {
+			return nil, errors.Errorf("Error unknown REDACT_DETECTORS %q", d)
+		}
+	}
+
+	params := splitList(getenv("REDACT_QUERY_PARAMS", defaultRedactQueryParams))
+	if len(params) > 0 {
+		quoted := make([]string, len(params))
+		for i, p := range params {
+			quoted[i] = regexp.QuoteMeta(p)
+		}
+		r.query = regexp.MustCompile(`(?i)((?:^|[?&;])(?:` + strings.Join(quoted, "|") + `)=)([^&#;\s"]*)`)
+	}
+	return r, nil
+}
+
+// replacedPattern matches a value that is already a replacement, so that
+// redacting an archived record again leaves it as it is in hash mode too.
+var replacedPattern = regexp.MustCompile(`^\[[A-Za-z]+:[0-9A-Za-z]+\]$`)
+
+// replacement returns what a sensitive value is replaced with.
+func (r *redactor) replacement(kind string, value string) string {
+	if r.mode == redactHash {
+		mac := hmac.New(sha256.New, r.salt)
+		mac.Write([]byte(value))
+		return "[" + kind + ":" + hex.EncodeToString(mac.Sum(nil))[:16] + "]"
+	}
+	return "[REDACTED:" + kind + "]"
+}
+
+// redactString masks the query-string parameters and the detected values.
+func (r *redactor) redactString(s string) string {
+	if r.query != nil {
+		s = r.query.ReplaceAllStringFunc(s, func(m string) string {
+			sub := r.query.FindStringSubmatch(m)
+			if sub[2] == "" || replacedPattern.MatchString(sub[2]) {
+				return m
+			}
+			return sub[1] + r.replacement("param", sub[2])
+		})
+	}
+	for _, name := range r.detectors {
+		detector := redactDetectors[name]
+		s = detector.ReplaceAllStringFunc(s, func(m string) string {
+			if name == "card" && !luhn(m) {
+				return m
+			}
+			return r.replacement(name, m)
+		})
+	}
+	return s
+}
+
+// luhn reports whether the digits pass the card number checksum.
+func luhn(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+// redact masks the string fields of the record in place. v is a pointer
+// to a record struct; fields are addressed by their json path, e.g.
+// extra.url.
+func (r *redactor) redact(v interface{}) {
+	if r.mode == redactOff {
+		return
+	}
+	r.walk("", reflect.ValueOf(v).Elem())
+}
+
+func (r *redactor) walk(path string, v reflect.Value) {
+	if r.allow[strings.ToLower(path)] {
+		return
+	}
+	denied := r.deny[strings.ToLower(path)]
+
+	switch v.Kind() {
+	case reflect.String:
+		if v.Len() == 0 {
+			return
+		}
+		if denied {
+			if !replacedPattern.MatchString(v.String()) {
+				v.SetString(r.replacement("field", v.String()))
+			}
+			return
+		}
+		v.SetString(r.redactString(v.String()))
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			r.walk(path, v.Index(i))
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "-" && f.Type.Kind() != reflect.Map {
+				continue
+			}
+			if f.Anonymous && name == "" {
+				r.walk(path, v.Field(i))
+				continue
+			}
+			if name == "" || name == "-" {
+				name = f.Name
+			}
+			r.walk(joinPath(path, name, f.Type.Kind() == reflect.Map), v.Field(i))
+		}
+	case reflect.Map:
+		// Overflow of unknown fields: map[string]json.RawMessage
+		raws, ok := v.Interface().(map[string]json.RawMessage)
+		if !ok {
+			return
+		}
+		for k, raw := range raws {
+			var value interface{}
+			if json.Unmarshal(raw, &value) != nil {
+				continue
+			}
+			b, err := json.Marshal(r.walkValue(joinPath(path, k, false), value))
+			if err == nil {
+				raws[k] = b
+			}
+		}
+	}
+}
+
+// walkValue redacts a decoded json value.
+func (r *redactor) walkValue(path string, value interface{}) interface{} {
+	if r.allow[strings.ToLower(path)] {
+		return value
+	}
+	switch v := value.(type) {
+	case string:
+		if r.deny[strings.ToLower(path)] {
+			if replacedPattern.MatchString(v) {
+				return v
+			}
+			return r.replacement("field", v)
+		}
+		return r.redactString(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = r.walkValue(path, v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = r.walkValue(joinPath(path, k, false), v[k])
+		}
+	}
+	return value
+}
+
+// joinPath appends the field name to the json path. The keys of an
+// overflow map are top-level fields of its record, so the map itself
+// adds nothing to the path.
+func joinPath(path string, name string, overflow bool) string {
+	if overflow {
+		return path
+	}
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
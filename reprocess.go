@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// Reprocess rebuilds Elasticsearch from the S3 archive:
+//
+//	sendlog reprocess -logname nginx_access -from 2019/08/23 [-to 2019/08/25]
+//
+// The archived records are decoded and indexed again with the current
+// parsers, enrichment and mappings. The archive is only read.
+
+// s3Archive lists and reads the archive objects. *s3.S3 implements it.
+type s3Archive interface {
+	ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, opts ...request.Option) error
+	GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error)
+}
+
+// newArchive returns the client of S3_BUCKET. Tests replace it with an
+// in-memory archive.
+var newArchive = func() s3Archive {
+	return s3.New(createSession())
+}
+
+// reprocessOptions are the flags of a reprocess run.
+type reprocessOptions struct {
+	logname    string
+	from       time.Time
+	to         time.Time
+	bucket     string
+	checkpoint string
+	bulk       int
+	rate       float64
+}
+
+func parseReprocessFlags(args []string) (reprocessOptions, error) {
+	var o reprocessOptions
+	var from, to string
+	fs := flag.NewFlagSet("reprocess", flag.ContinueOnError)
+	fs.StringVar(&o.logname, "logname", "", "archive to reprocess, e.g. nginx_access or application")
+	fs.StringVar(&from, "from", "", "first day of the keys (the Kinesis arrival day in JST), YYYY/MM/DD")
+	fs.StringVar(&to, "to", "", "last day, YYYY/MM/DD (default -from)")
+	fs.StringVar(&o.bucket, "bucket", os.Getenv("S3_BUCKET"), "archive bucket")
+	fs.StringVar(&o.checkpoint, "checkpoint", "", "file of the last indexed object (default reprocess-<logname>-<from>-<to>.checkpoint)")
+	fs.IntVar(&o.bulk, "bulk", 500, "documents per bulk request")
+	fs.Float64Var(&o.rate, "rate", 0, "documents per second, 0 for no limit")
+	if err := fs.Parse(args); err != nil {
+		return o, err
+	}
+
+	if o.logname == "" || strings.Contains(o.logname, "/") {
+		return o, errors.Errorf("Error invalid logname %q", o.logname)
+	}
+	if o.bucket == "" {
+		return o, errors.New("Error no bucket, set -bucket or S3_BUCKET")
+	}
+	if o.bulk <= 0 {
+		return o, errors.Errorf("Error invalid bulk size %d", o.bulk)
+	}
+	if to == "" {
+		to = from
+	}
+	var err error
+	if o.from, err = time.Parse("2006/01/02", from); err != nil {
+		return o, errors.Wrap(err, "Error invalid -from")
+	}
+	if o.to, err = time.Parse("2006/01/02", to); err != nil {
+		return o, errors.Wrap(err, "Error invalid -to")
+	}
+	if o.to.Before(o.from) {
+		return o, errors.Errorf("Error -to %s is before -from %s", to, from)
+	}
+	if o.checkpoint == "" {
+		o.checkpoint = "reprocess-" + o.logname + "-" + o.from.Format("20060102") + "-" + o.to.Format("20060102") + ".checkpoint"
+	}
+	return o, nil
+}
+
+// prefixes are the key prefixes of the days, in key order. s3Upload
+// writes /<logname>/YYYY/MM/DD/HH/...
+func (o reprocessOptions) prefixes() []string {
+	var ps []string
+	for d := o.from; !d.After(o.to); d = d.AddDate(0, 0, 1) {
+		ps = append(ps, "/"+o.logname+"/"+d.Format("2006/01/02")+"/")
+	}
+	return ps
+}
+
+// readCheckpoint returns the last indexed key, or "" to start over.
+func readCheckpoint(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "Error failed to read checkpoint")
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// removeCheckpoint deletes the checkpoint of a finished run, so that the
+// next run starts over.
+func removeCheckpoint(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Error failed to remove checkpoint")
+	}
+	return nil
+}
+
+// writeCheckpoint replaces the checkpoint, so that an interrupted write
+// leaves the previous one.
+func writeCheckpoint(path string, key string) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(key+"\n"), 0644); err != nil {
+		return errors.Wrap(err, "Error failed to write checkpoint")
+	}
+	return errors.Wrap(os.Rename(tmp, path), "Error failed to write checkpoint")
+}
+
+// archiveLines reads the JSON lines of a gzip object.
+func archiveLines(r io.Reader) ([][]byte, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var lines [][]byte
+	s := bufio.NewScanner(zr)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for s.Scan() {
+		// older objects end every line but the last with a comma.
+		line := bytes.TrimSuffix(bytes.TrimSpace(s.Bytes()), []byte(","))
+		if len(line) > 0 {
+			lines = append(lines, append([]byte(nil), line...))
+		}
+	}
+	return lines, s.Err()
+}
+
+// throttledSink spaces the bulk requests to rate documents per second.
+type throttledSink struct {
+	sink esSink
+	rate float64
+	next time.Time
+}
+
+func (s *throttledSink) Index(ctx context.Context, docs []esDoc) error {
+	if s.rate > 0 {
+		select {
+		case <-time.After(time.Until(s.next)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		s.next = time.Now().Add(time.Duration(float64(len(docs)) / s.rate * float64(time.Second)))
+	}
+	return s.sink.Index(ctx, docs)
+}
+
+// readOnlyUploader refuses every upload, so that reprocessing never
+// writes to the archive.
+type readOnlyUploader struct{}
+
+func (readOnlyUploader) Upload(input *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	return nil, errors.Errorf("Error reprocess does not write to S3 (%s)", aws.StringValue(input.Key))
+}
+
+// runReprocess indexes the archived objects of the days in key order.
+// reindex is called with up to -bulk lines of one object; the checkpoint
+// is written after each object, so that a rerun of an interrupted run
+// resumes after it, and removed when every object is indexed.
+func runReprocess(ctx context.Context, args []string, reindex func(context.Context, string, [][]byte) error) error {
+	o, err := parseReprocessFlags(args)
+	if err != nil {
+		return err
+	}
+	last, err := readCheckpoint(o.checkpoint)
+	if err != nil {
+		return err
+	}
+	if last != "" {
+		fmt.Println("resume after", last)
+	}
+
+	sink, err := newESSink()
+	if err != nil {
+		return errors.Wrap(err, "Error failed to elasticsearch access")
+	}
+	throttled := &throttledSink{sink: sink, rate: o.rate}
+	orgUploader, orgSink := newUploader, newESSink
+	defer func() { newUploader, newESSink = orgUploader, orgSink }()
+	newUploader = func() s3Uploader { return readOnlyUploader{} }
+	newESSink = func() (esSink, error) { return throttled, nil }
+
+	archive := newArchive()
+	objects, lines := 0, 0
+	for _, prefix := range o.prefixes() {
+		var keys []string
+		input := &s3.ListObjectsV2Input{Bucket: aws.String(o.bucket), Prefix: aws.String(prefix)}
+		if last > prefix {
+			input.StartAfter = aws.String(last)
+		}
+		err := archive.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				keys = append(keys, aws.StringValue(obj.Key))
+			}
+			return true
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Error failed to list %s", prefix)
+		}
+
+		for _, key := range keys {
+			if key <= last {
+				continue
+			}
+			out, err := archive.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(o.bucket), Key: aws.String(key)})
+			if err != nil {
+				return errors.Wrapf(err, "Error failed to get %s", key)
+			}
+			ls, err := archiveLines(out.Body)
+			out.Body.Close()
+			if err != nil {
+				return errors.Wrapf(err, "Error failed to read %s", key)
+			}
+
+			for i := 0; i < len(ls); i += o.bulk {
+				end := i + o.bulk
+				if end > len(ls) {
+					end = len(ls)
+				}
+				if err := reindex(ctx, o.logname, ls[i:end]); err != nil {
+					return errors.Wrapf(err, "Error failed to reindex %s", key)
+				}
+			}
+			if err := writeCheckpoint(o.checkpoint, key); err != nil {
+				return err
+			}
+			objects++
+			lines += len(ls)
+			fmt.Printf("reindexed %s (%d lines)\n", key, len(ls))
+		}
+	}
+	fmt.Printf("reindexed %d objects, %d lines\n", objects, lines)
+	return removeCheckpoint(o.checkpoint)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// routeSegments replace the path segments that are ids, in order.
+var routeSegments = []struct {
+	placeholder string
+	pattern     *regexp.Regexp
+}{
+	{":id", regexp.MustCompile(`^\d+$`)},
+	{":uuid", regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)},
+	{":hash", regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)},
+	{":token", regexp.MustCompile(`^[A-Za-z0-9_-]*\d[A-Za-z0-9_-]*$`)},
+}
+
+// routeTokenLength is the shortest segment taken for a token. Shorter
+// ones with digits are names like v1 or top10.
+const routeTokenLength = 20
+
+// routeRule replaces the path of a matching request with Route, which
+// may refer to the submatches of Pattern ($1). An empty Host matches any
+// host.
+type routeRule struct {
+	Host    string `json:"host"`
+	Pattern string `json:"pattern"`
+	Route   string `json:"route"`
+
+	re *regexp.Regexp
+}
+
+// routeNormalizer derives the route template and the parsed query of an
+// access log.
+type routeNormalizer struct {
+	rules []routeRule
+}
+
+// newRouteNormalizer reads the rules from the JSON file named by
+// ROUTE_RULES, e.g. [{"host": "api.example.com", "pattern": "^/shops/[^/]+", "route": "/shops/:shop"}].
+func newRouteNormalizer() (*routeNormalizer, error) {
+	n := &routeNormalizer{}
+
+	file := os.Getenv("ROUTE_RULES")
+	if file == "" {
+		return n, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error failed to read ROUTE_RULES")
+	}
+	if err := json.Unmarshal(b, &n.rules); err != nil {
+		return nil, errors.Wrap(err, "Error failed to parse ROUTE_RULES")
+	}
+	for i := range n.rules {
+		n.rules[i].re, err = regexp.Compile(n.rules[i].Pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error invalid ROUTE_RULES pattern %q", n.rules[i].Pattern)
+		}
+	}
+	return n, nil
+}
+
+// requestPath returns the path of request_uri, or uri if nginx did not
+// log it.
+func requestPath(v Nginx) string {
+	p := v.Request_uri
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+	if p == "" || p == "-" {
+		p = v.Uri
+	}
+	return p
+}
+
+// route replaces the ids of the path with placeholders. The first
+// matching rule of the host wins over the placeholders.
+func (n *routeNormalizer) route(host string, path string) string {
+	for _, r := range n.rules {
+		if r.Host != "" && !strings.EqualFold(r.Host, host) {
+			continue
+		}
+		if r.re.MatchString(path) {
+			return r.re.ReplaceAllString(path, r.Route)
+		}
+	}
+
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		for _, p := range routeSegments {
+			if p.placeholder == ":token" && len(s) < routeTokenLength {
+				continue
+			}
+			if p.pattern.MatchString(s) {
+				segments[i] = p.placeholder
+				break
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// parseQuery splits query_string (or the query of request_uri) into a
+// map. Repeated parameters are joined with a comma.
+func parseQuery(v Nginx) map[string]string {
+	q := v.Query_string
+	if q == "" || q == "-" {
+		if i := strings.Index(v.Request_uri, "?"); i >= 0 {
+			q = v.Request_uri[i+1:]
+		}
+	}
+	if q == "" || q == "-" {
+		return nil
+	}
+
+	// a malformed pair is skipped, the rest is kept.
+	values, _ := url.ParseQuery(q)
+	if len(values) == 0 {
+		return nil
+	}
+	query := make(map[string]string, len(values))
+	for k, vs := range values {
+		query[k] = strings.Join(vs, ",")
+	}
+	return query
+}
+
+// normalize sets the route and the query of the access log.
+func (n *routeNormalizer) normalize(v *Nginx) {
+	if p := requestPath(*v); p != "" && p != "-" {
+		v.Route = n.route(v.Host, p)
+	}
+	v.Query = parseQuery(*v)
+}
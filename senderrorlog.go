@@ -15,26 +15,69 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type NginxError struct {
-	Logname   string `json:"nginx_error"`
-	Timestamp string `json:"time_stamp"`
-	Loglevel  string `json:"log_level"`
-	Message   string `json:"message"`
+	Logname    string `json:"nginx_error"`
+	Timestamp  string `json:"time_stamp"`
+	Loglevel   string `json:"log_level"`
+	Message    string `json:"message"`
+	Pid        string `json:"pid,omitempty"`
+	Tid        string `json:"tid,omitempty"`
+	Connection string `json:"connection_id,omitempty"`
+	Client     string `json:"client,omitempty"`
+	Server     string `json:"server,omitempty"`
+	Request    string `json:"request,omitempty"`
+	Upstream   string `json:"upstream,omitempty"`
+	Host       string `json:"host,omitempty"`
+	Referrer   string `json:"referrer,omitempty"`
+
+	// DocId is the Elasticsearch _id, archived so that reprocess
+	// overwrites the documents indexed from Kinesis.
+	DocId string `json:"doc_id,omitempty"`
+
+	NormalizedTime
 }
 
 type PhpError struct {
-	Logname   string `json:"php-fpm-error"`
-	Timestamp string `json:"time_stamp"`
-	Loglevel  string `json:"log_level"`
-	Message   string `json:"message"`
+	Logname   string   `json:"php-fpm-error"`
+	Timestamp string   `json:"time_stamp"`
+	Loglevel  string   `json:"log_level"`
+	Message   string   `json:"message"`
+	Pool      string   `json:"pool,omitempty"`
+	Pid       string   `json:"pid,omitempty"`
+	ExitCode  string   `json:"exit_code,omitempty"`
+	Signal    string   `json:"signal,omitempty"`
+	Type      string   `json:"type,omitempty"`
+	File      string   `json:"file,omitempty"`
+	Line      string   `json:"line,omitempty"`
+	Stack     []string `json:"stack,omitempty"`
+
+	// DocId is the archived Elasticsearch _id, the id of the first line
+	// of a joined error.
+	DocId string `json:"doc_id,omitempty"`
+
+	NormalizedTime
+}
+
+type PhpSlowlog struct {
+	Logname   string   `json:"php-fpm-slowlog"`
+	Timestamp string   `json:"time_stamp"`
+	Pool      string   `json:"pool"`
+	Pid       string   `json:"pid"`
+	Script    string   `json:"script"`
+	Duration  string   `json:"duration,omitempty"`
+	Frames    []string `json:"frames"`
+
+	NormalizedTime
 }
 
 type NginxErrors []NginxError
 type PhpErrors []PhpError
+type PhpSlowlogs []PhpSlowlog
 
 // send notification to slack.
 func webhook(message string) error {
@@ -94,9 +137,7 @@ func s3Upload(buf bytes.Buffer, convertData []byte, logname string) (*s3manager.
 		return nil, errors.Wrap(err, "Error failed compress")
 	}
 
-	sess := createSession()
-
-	var uploader = s3manager.NewUploader(sess)
+	uploader := newUploader()
 
 	jst := time.FixedZone("Asia/Tokyo", 9*60*60)
 	t := time.Now().In(jst).Format("2006/01/02 15:04:05")
@@ -125,45 +166,308 @@ func compress(w io.Writer, convertData []byte) error {
 }
 
 //For JSON lines (support athena JSON SerDe libraries)func marshalAthena(v interface{}) ([]byte, error) {
+// One record per line; the records are marshaled as they are, so that
+// brackets and braces in the values are kept.
 func marshalAthena(v interface{}) ([]byte, error) {
-	vathena, err := json.Marshal(v)
-	vathena = bytes.ReplaceAll(vathena, []byte("[{"), []byte("{"))
-	vathena = bytes.ReplaceAll(vathena, []byte("},{"), []byte("},\n{"))
-	vathena = bytes.ReplaceAll(vathena, []byte("}]"), []byte("}"))
-	return vathena, err
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var records []json.RawMessage
+	if err := json.Unmarshal(b, &records); err != nil {
+		return b, nil
+	}
+	lines := make([][]byte, len(records))
+	for i, r := range records {
+		lines[i] = r
+	}
+	return bytes.Join(lines, []byte("\n")), nil
+}
+
+// indexNginxErrors sends nginx error log to ES_NGINX_ERROR_INDEX if set.
+func indexNginxErrors(ctx context.Context, nginxerrors NginxErrors, times []time.Time) error {
+	index := os.Getenv("ES_NGINX_ERROR_INDEX")
+	if index == "" {
+		return nil
+	}
+
+	sink, err := newESSink()
+	if err != nil {
+		return errors.Wrap(err, "Error failed to elasticsearch access")
+	}
+
+	docs := make([]esDoc, 0, len(nginxerrors))
+	for i, record := range nginxerrors {
+		id := record.DocId
+		record.DocId = ""
+		if id == "" {
+			id = contentID(record)
+		}
+		docs = append(docs, esDoc{
+			Id:    id,
+			Index: indexName(index, timeOrNow(times[i])),
+			Type:  os.Getenv("ES_NGINX_ERROR_INDEXTYPE"),
+			Body:  record,
+		})
+	}
+	return sink.Index(ctx, docs)
+}
+
+// indexPhpErrors sends php-fpm error log to ES_PHP_ERROR_INDEX if set.
+func indexPhpErrors(ctx context.Context, phperrors PhpErrors, times []time.Time) error {
+	index := os.Getenv("ES_PHP_ERROR_INDEX")
+	if index == "" {
+		return nil
+	}
+
+	sink, err := newESSink()
+	if err != nil {
+		return errors.Wrap(err, "Error failed to elasticsearch access")
+	}
+
+	docs := make([]esDoc, 0, len(phperrors))
+	for i, record := range phperrors {
+		id := record.DocId
+		record.DocId = ""
+		if id == "" {
+			id = contentID(record)
+		}
+		docs = append(docs, esDoc{
+			Id:    id,
+			Index: indexName(index, timeOrNow(times[i])),
+			Type:  os.Getenv("ES_PHP_ERROR_INDEXTYPE"),
+			Body:  record,
+		})
+	}
+	return sink.Index(ctx, docs)
+}
+
+// alertSlowScripts notifies the scripts found SLOWLOG_BATCH_ALERT_COUNT
+// times or more in the batch (only those slower than SLOWLOG_ALERT_SECONDS,
+// if set). The entries are counted per Kinesis batch only, nothing is kept
+// between invocations, so the count is bounded by the batch size of the
+// event source. It does nothing when the count is not set.
+func alertSlowScripts(phpslowlogs PhpSlowlogs) error {
+	count, _ := strconv.Atoi(os.Getenv("SLOWLOG_BATCH_ALERT_COUNT"))
+	if count <= 0 {
+		return nil
+	}
+	seconds, _ := strconv.ParseFloat(os.Getenv("SLOWLOG_ALERT_SECONDS"), 64)
+
+	scripts, counts := slowScripts(phpslowlogs, count, seconds)
+	for _, script := range scripts {
+		err := webhook(fmt.Sprintf("php-fpm slowlog: %s was slow %d times", script, counts[script]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archivedTime is the @timestamp of an archived record, or its
+// time_stamp normalized again.
+func archivedTime(n *timeNormalizer, nt NormalizedTime, value string, layouts []string) (NormalizedTime, time.Time) {
+	if t, err := time.Parse(time.RFC3339, nt.Utc); err == nil {
+		return nt, t
+	}
+	return n.normalizeZoned(value, layouts)
+}
+
+// reindex decodes archived error logs and indexes them again under their
+// archived document ids. Records archived before redaction are redacted;
+// redacting the others again leaves them as they are. php-fpm slowlog is
+// archived only.
+func reindex(ctx context.Context, logname string, lines [][]byte) error {
+	normalizer, err := newTimeNormalizer()
+	if err != nil {
+		return err
+	}
+	r, err := newRedactor()
+	if err != nil {
+		return err
+	}
+
+	switch logname {
+	case "nginx_error":
+		if os.Getenv("ES_NGINX_ERROR_INDEX") == "" {
+			return errors.New("Error ES_NGINX_ERROR_INDEX is not set")
+		}
+		var nginxerrors NginxErrors
+		var times []time.Time
+		for _, line := range lines {
+			var nginxerror NginxError
+			if err := json.Unmarshal(line, &nginxerror); err != nil {
+				fmt.Println("Error failed to decode nginx error log", err)
+				continue
+			}
+			r.redact(&nginxerror)
+			nt, t := archivedTime(normalizer, nginxerror.NormalizedTime, nginxerror.Timestamp, nginxErrorTimeLayouts)
+			nginxerror.NormalizedTime = nt
+			nginxerrors = append(nginxerrors, nginxerror)
+			times = append(times, t)
+		}
+		return indexNginxErrors(ctx, nginxerrors, times)
+	case "php-fpm-error":
+		if os.Getenv("ES_PHP_ERROR_INDEX") == "" {
+			return errors.New("Error ES_PHP_ERROR_INDEX is not set")
+		}
+		var phperrors PhpErrors
+		var times []time.Time
+		for _, line := range lines {
+			var phperror PhpError
+			if err := json.Unmarshal(line, &phperror); err != nil {
+				fmt.Println("Error failed to decode php-fpm error log", err)
+				continue
+			}
+			r.redact(&phperror)
+			nt, t := archivedTime(normalizer, phperror.NormalizedTime, phperror.Timestamp, phpErrorTimeLayouts)
+			phperror.NormalizedTime = nt
+			phperrors = append(phperrors, phperror)
+			times = append(times, t)
+		}
+		return indexPhpErrors(ctx, phperrors, times)
+	}
+	return errors.Errorf("Error %q is not indexed", logname)
 }
 
 func handler(ctx context.Context, kinesisEvent events.KinesisEvent) error {
 
 	var dataBytes []byte
-	var nginxerror NginxError
 	var nginxerrors NginxErrors
-	var phperror PhpError
+	var nginxerrortimes []time.Time
 	var phperrors PhpErrors
+	var phperrortimes []time.Time
+
+	normalizer, err := newTimeNormalizer()
+	if err != nil {
+		return err
+	}
+	joiner := newPhpErrorJoiner()
+	slowjoiner := newPhpSlowlogJoiner()
+	// dropped counts the records that could not be decoded.
+	dropped := 0
 
 	for _, record := range kinesisEvent.Records {
 		kinesisRecord := record.Kinesis
 		dataBytes = kinesisRecord.Data
 
 		// Extract substring from KinesisRecord
-		if bytes.Contains(dataBytes, []byte("nginx_error")) != false {
-			json.Unmarshal(dataBytes, &nginxerror)
+		if isNginxErrorLine(dataBytes) {
+			nginxerror, _ := parseNginxErrorLine(dataBytes)
+			nginxerror.DocId = kinesisID(record)
+			nt, t := normalizer.normalize(nginxerror.Timestamp, nginxErrorTimeLayouts)
+			nginxerror.NormalizedTime = nt
+			nginxerrors = append(nginxerrors, nginxerror)
+			nginxerrortimes = append(nginxerrortimes, t)
+		} else if bytes.Contains(dataBytes, []byte("nginx_error")) != false {
+			var nginxerror NginxError
+			if err := json.Unmarshal(dataBytes, &nginxerror); err != nil {
+				fmt.Println("Error failed to decode nginx error log", record.EventID, err)
+				dropped++
+				continue
+			}
+			parseNginxErrorMessage(&nginxerror)
+			nginxerror.DocId = kinesisID(record)
+			nt, t := normalizer.normalize(nginxerror.Timestamp, nginxErrorTimeLayouts)
+			nginxerror.NormalizedTime = nt
 			nginxerrors = append(nginxerrors, nginxerror)
+			nginxerrortimes = append(nginxerrortimes, t)
+		} else if isPhpSlowlog(dataBytes) {
+			phpslowlog, _ := parsePhpSlowlog(dataBytes)
+			slowjoiner.add(kinesisRecord.PartitionKey, phpslowlog)
+		} else if bytes.Contains(dataBytes, []byte("php-fpm-slowlog")) == true {
+			var phpslowlog PhpSlowlog
+			if err := json.Unmarshal(dataBytes, &phpslowlog); err != nil {
+				fmt.Println("Error failed to decode php-fpm slowlog", record.EventID, err)
+				dropped++
+				continue
+			}
+			slowjoiner.add(kinesisRecord.PartitionKey, phpslowlog)
+		} else if isPhpSlowlogContinuation(dataBytes) && slowjoiner.continueLine(kinesisRecord.PartitionKey, string(dataBytes)) {
+			continue
+		} else if isPhpErrorLine(dataBytes) {
+			phperror, _ := parsePhpErrorLine(dataBytes)
+			phperror.DocId = kinesisID(record)
+			joiner.add(kinesisRecord.PartitionKey, phperror)
 		} else if bytes.Contains(dataBytes, []byte("php-fpm-error")) == true {
-			json.Unmarshal(dataBytes, &phperror)
-			t, _ := time.Parse("02-Jan-2006 15:04:05", phperror.Timestamp)
-			phperror.Timestamp = t.Format("2006/01/02 15:04:05") // for athena format
-			phperrors = append(phperrors, phperror)
+			var phperror PhpError
+			if err := json.Unmarshal(dataBytes, &phperror); err != nil {
+				fmt.Println("Error failed to decode php-fpm error log", record.EventID, err)
+				dropped++
+				continue
+			}
+			parsePhpErrorMessage(&phperror)
+			phperror.DocId = kinesisID(record)
+			joiner.add(kinesisRecord.PartitionKey, phperror)
+		} else if joiner.continueLine(kinesisRecord.PartitionKey, string(dataBytes)) {
+			continue
+		} else if line := strings.TrimSpace(string(dataBytes)); line != "" {
+			// a line of no known format is kept as a record of its own.
+			phperror := PhpError{Logname: "php-fpm-error", Message: line}
+			parsePhpErrorMessage(&phperror)
+			phperror.DocId = kinesisID(record)
+			joiner.add(kinesisRecord.PartitionKey, phperror)
+		}
+	}
+	if dropped > 0 {
+		fmt.Printf("dropped %d undecodable records of %d\n", dropped, len(kinesisEvent.Records))
+	}
+
+	for _, phperror := range joiner.records {
+		nt, t := normalizer.normalizeZoned(phperror.Timestamp, phpErrorTimeLayouts)
+		phperror.NormalizedTime = nt
+		// for athena format; an unparsed time is kept as it is.
+		if !nt.Unparsed {
+			phperror.Timestamp = t.Format("2006/01/02 15:04:05")
+		}
+		phperrors = append(phperrors, phperror)
+		phperrortimes = append(phperrortimes, t)
+	}
+
+	slowjoiner.setDurations(joiner.records)
+	phpslowlogs := slowjoiner.records
+	for i := range phpslowlogs {
+		nt, t := normalizer.normalizeZoned(phpslowlogs[i].Timestamp, phpErrorTimeLayouts)
+		phpslowlogs[i].NormalizedTime = nt
+		if !nt.Unparsed {
+			phpslowlogs[i].Timestamp = t.Format("2006/01/02 15:04:05")
 		}
 	}
 
+	// mask sensitive data before any sink sees the records.
+	r, err := newRedactor()
+	if err != nil {
+		return err
+	}
+	for i := range nginxerrors {
+		r.redact(&nginxerrors[i])
+	}
+	for i := range phperrors {
+		r.redact(&phperrors[i])
+	}
+	for i := range phpslowlogs {
+		r.redact(&phpslowlogs[i])
+	}
+
+	// the document ids are archived with the records, for reprocess.
+	for i := range nginxerrors {
+		id := nginxerrors[i].DocId
+		nginxerrors[i].DocId = ""
+		nginxerrors[i].DocId = docID(id, nginxerrors[i])
+	}
+	for i := range phperrors {
+		id := phperrors[i].DocId
+		phperrors[i].DocId = ""
+		phperrors[i].DocId = docID(id, phperrors[i])
+	}
+
 	if nginxerrors != nil {
 		var nginxerrorbuf bytes.Buffer
 
 		// When loglevel is error, send a slack notification.
 		for _, record := range nginxerrors {
 			if record.Loglevel == "error" {
-				err := webhook(record.Message)
+				err := webhook(record.alertMessage())
 				if err != nil {
 					return errors.Wrap(err, "Error failed to send nginx_error notification to slack")
 				}
@@ -175,15 +479,21 @@ func handler(ctx context.Context, kinesisEvent events.KinesisEvent) error {
 		if err != nil {
 			return errors.Wrap(err, "Error failed to s3 upload")
 		}
+
+		err = indexNginxErrors(ctx, nginxerrors, nginxerrortimes)
+		if err != nil {
+			return err
+		}
 	}
 
 	if phperrors != nil {
 		var phperrorbuf bytes.Buffer
 
 		// When loglevel is higher than warning, send a slack notification.
+		// Lines of no known format have no level and are not notified.
 		for _, record := range phperrors {
-			if record.Loglevel != "NOTICE" {
-				err := webhook(record.Message)
+			if record.Loglevel != "" && record.Loglevel != "NOTICE" {
+				err := webhook(record.alertMessage())
 				if err != nil {
 					return errors.Wrap(err, "Error failed to send php-fpm-error notification to slack")
 				}
@@ -195,10 +505,44 @@ func handler(ctx context.Context, kinesisEvent events.KinesisEvent) error {
 		if err != nil {
 			return errors.Wrap(err, "Error failed to s3 upload")
 		}
+
+		err = indexPhpErrors(ctx, phperrors, phperrortimes)
+		if err != nil {
+			return err
+		}
+	}
+
+	if phpslowlogs != nil {
+		var phpslowlogbuf bytes.Buffer
+
+		// When a script is slow repeatedly, send a slack notification.
+		err := alertSlowScripts(phpslowlogs)
+		if err != nil {
+			return errors.Wrap(err, "Error failed to send php-fpm-slowlog notification to slack")
+		}
+
+		phpslowlogjson, _ := marshalAthena(phpslowlogs)
+		_, err = s3Upload(phpslowlogbuf, phpslowlogjson, "php-fpm-slowlog")
+		if err != nil {
+			return errors.Wrap(err, "Error failed to s3 upload")
+		}
 	}
 	return nil
 }
 
 func main() {
+	if !isLambda() {
+		var err error
+		if len(os.Args) > 1 && os.Args[1] == "reprocess" {
+			err = runReprocess(context.Background(), os.Args[2:], reindex)
+		} else {
+			err = runKinesis(os.Args[1:], os.Stdin, os.Stdout, handler)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 	lambda.Start(handler)
 }
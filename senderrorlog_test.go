@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseNginxErrorLine(t *testing.T) {
+	t.Run("upstream timed out", func(t *testing.T) {
+		line := `2019/08/23 15:37:26 [error] 123#0: *45 upstream timed out (110: Connection timed out) while reading response header from upstream, client: 1.2.3.4, server: example.com, request: "GET /api/users?id=1 HTTP/1.1", upstream: "fastcgi://unix:/run/php-fpm.sock:", host: "example.com"`
+
+		e, ok := parseNginxErrorLine([]byte(line))
+		if !ok {
+			t.Fatal("Error failed to parse nginx error line")
+		}
+
+		want := NginxError{
+			Logname:    "nginx_error",
+			Timestamp:  "2019/08/23 15:37:26",
+			Loglevel:   "error",
+			Message:    "upstream timed out (110: Connection timed out) while reading response header from upstream",
+			Pid:        "123",
+			Tid:        "0",
+			Connection: "45",
+			Client:     "1.2.3.4",
+			Server:     "example.com",
+			Request:    "GET /api/users?id=1 HTTP/1.1",
+			Upstream:   "fastcgi://unix:/run/php-fpm.sock:",
+			Host:       "example.com",
+		}
+		if e != want {
+			t.Errorf("got: %+v\nwant: %+v", e, want)
+		}
+	})
+
+	t.Run("without connection", func(t *testing.T) {
+		line := `2019/08/23 15:37:26 [emerg] 1#1: bind() to 0.0.0.0:80 failed (98: Address already in use)`
+
+		e, ok := parseNginxErrorLine([]byte(line))
+		if !ok {
+			t.Fatal("Error failed to parse nginx error line")
+		}
+		if e.Loglevel != "emerg" || e.Pid != "1" || e.Connection != "" || e.Message != "bind() to 0.0.0.0:80 failed (98: Address already in use)" {
+			t.Errorf("got: %+v", e)
+		}
+	})
+
+	t.Run("not an error line", func(t *testing.T) {
+		if isNginxErrorLine([]byte(`{"nginx_error":"nginx_error","log_level":"error"}`)) {
+			t.Error("Error json detected as error line")
+		}
+	})
+}
+
+func TestParsePhpErrorLine(t *testing.T) {
+	t.Run("child exit code", func(t *testing.T) {
+		e, ok := parsePhpErrorLine([]byte(`[23-Aug-2019 15:37:26] WARNING: [pool www] child 123 exited with code 255 after 1.234 seconds from start`))
+		if !ok {
+			t.Fatal("Error failed to parse php-fpm line")
+		}
+		if e.Loglevel != "WARNING" || e.Pool != "www" || e.Pid != "123" || e.ExitCode != "255" {
+			t.Errorf("got: %+v", e)
+		}
+	})
+
+	t.Run("child signal", func(t *testing.T) {
+		e, _ := parsePhpErrorLine([]byte(`[23-Aug-2019 15:37:26] WARNING: [pool www] child 124 exited on signal 11 (SIGSEGV) after 12.3 seconds from start`))
+		if e.Pid != "124" || e.Signal != "SIGSEGV" {
+			t.Errorf("got: %+v", e)
+		}
+	})
+
+	t.Run("fatal error", func(t *testing.T) {
+		e, _ := parsePhpErrorLine([]byte(`[23-Aug-2019 06:37:26 UTC] PHP Fatal error:  Uncaught Exception: boom in /var/www/app.php:12`))
+		if e.Loglevel != "ERROR" || e.Type != "Fatal error" || e.File != "/var/www/app.php" || e.Line != "12" || e.Message != "Uncaught Exception: boom in /var/www/app.php:12" {
+			t.Errorf("got: %+v", e)
+		}
+		if e.Timestamp != "23-Aug-2019 06:37:26 UTC" {
+			t.Errorf("got: %v\nwant: %v", e.Timestamp, "23-Aug-2019 06:37:26 UTC")
+		}
+	})
+
+	t.Run("timezone name", func(t *testing.T) {
+		e, ok := parsePhpErrorLine([]byte(`[23-Aug-2019 15:37:26 America/Argentina/Buenos_Aires] PHP Notice:  Undefined index: id in /var/www/app.php on line 40`))
+		if !ok || e.Timestamp != "23-Aug-2019 15:37:26 America/Argentina/Buenos_Aires" || e.Loglevel != "NOTICE" {
+			t.Errorf("got: %+v", e)
+		}
+	})
+
+	t.Run("warning on line", func(t *testing.T) {
+		e, _ := parsePhpErrorLine([]byte(`[23-Aug-2019 06:37:26 UTC] PHP Warning:  Division by zero in /var/www/app.php on line 37`))
+		if e.Loglevel != "WARNING" || e.File != "/var/www/app.php" || e.Line != "37" {
+			t.Errorf("got: %+v", e)
+		}
+	})
+}
+
+func TestPhpErrorJoiner(t *testing.T) {
+	lines := []struct {
+		partitionKey string
+		data         string
+	}{
+		{"web-1", `[23-Aug-2019 06:37:26 UTC] PHP Fatal error:  Uncaught Exception: boom in /var/www/app.php:12`},
+		{"web-2", `[23-Aug-2019 06:37:26 UTC] PHP Warning:  Division by zero in /var/www/app.php on line 37`},
+		{"web-1", `Stack trace:`},
+		{"web-1", `#0 /var/www/index.php(3): run()`},
+		{"web-1", `#1 {main}`},
+		{"web-1", `  thrown in /var/www/app.php on line 12`},
+		{"web-2", `[23-Aug-2019 06:37:26 UTC] PHP Stack trace:`},
+		{"web-2", `[23-Aug-2019 06:37:26 UTC] PHP   1. {main}() /var/www/index.php:0`},
+		{"web-2", `[23-Aug-2019 06:37:27 UTC] PHP Notice:  Undefined index: id in /var/www/app.php on line 40`},
+	}
+
+	j := newPhpErrorJoiner()
+	for _, l := range lines {
+		if isPhpErrorLine([]byte(l.data)) {
+			e, _ := parsePhpErrorLine([]byte(l.data))
+			j.add(l.partitionKey, e)
+		} else if !j.continueLine(l.partitionKey, l.data) {
+			t.Fatalf("Error line not joined: %s", l.data)
+		}
+	}
+
+	if len(j.records) != 3 {
+		t.Fatalf("got: %v\nwant: %v", len(j.records), 3)
+	}
+	want := []string{"#0 /var/www/index.php(3): run()", "#1 {main}", "thrown in /var/www/app.php on line 12"}
+	if len(j.records[0].Stack) != len(want) {
+		t.Fatalf("got: %v\nwant: %v", j.records[0].Stack, want)
+	}
+	for i := range want {
+		if j.records[0].Stack[i] != want[i] {
+			t.Errorf("got: %v\nwant: %v", j.records[0].Stack[i], want[i])
+		}
+	}
+	if len(j.records[1].Stack) != 1 || j.records[1].Stack[0] != "1. {main}() /var/www/index.php:0" {
+		t.Errorf("got: %v\nwant: %v", j.records[1].Stack, "1. {main}() /var/www/index.php:0")
+	}
+	if j.records[2].Type != "Notice" {
+		t.Errorf("got: %v\nwant: %v", j.records[2].Type, "Notice")
+	}
+	if j.continueLine("web-1", "PHP Warning:  Division by zero") {
+		t.Error("Error joined a line that is not a stack trace line")
+	}
+}
+
+func TestPhpSlowlog(t *testing.T) {
+	lines := []string{
+		`[23-Aug-2019 15:37:26]  [pool www] pid 123`,
+		`script_filename = /var/www/public/index.php`,
+		`[0x00007f3b5c81e0a8] curl_exec() /var/www/app/Http/Client.php:45`,
+		`[0x00007f3b5c81e010] request() /var/www/app/Http/Controllers/ExampleController.php:20`,
+	}
+
+	t.Run("separate records", func(t *testing.T) {
+		j := newPhpSlowlogJoiner()
+		for _, l := range lines {
+			if isPhpSlowlog([]byte(l)) {
+				s, _ := parsePhpSlowlog([]byte(l))
+				j.add("web-1", s)
+			} else if !isPhpSlowlogContinuation([]byte(l)) || !j.continueLine("web-1", l) {
+				t.Fatalf("Error line not joined: %s", l)
+			}
+		}
+
+		warning, _ := parsePhpErrorLine([]byte(`[23-Aug-2019 15:37:26] WARNING: [pool www] child 123, script '/var/www/public/index.php' (request: "GET /index.php") executing too slow (5.123 sec), logging`))
+		j.setDurations(PhpErrors{warning})
+
+		if len(j.records) != 1 {
+			t.Fatalf("got: %v\nwant: %v", len(j.records), 1)
+		}
+		s := j.records[0]
+		if s.Pool != "www" || s.Pid != "123" || s.Script != "/var/www/public/index.php" || s.Duration != "5.123" || len(s.Frames) != 2 {
+			t.Errorf("got: %+v", s)
+		}
+		if s.Frames[0] != "curl_exec() /var/www/app/Http/Client.php:45" {
+			t.Errorf("got: %v\nwant: %v", s.Frames[0], "curl_exec() /var/www/app/Http/Client.php:45")
+		}
+	})
+
+	t.Run("one record", func(t *testing.T) {
+		data := []byte(strings.Join(lines, "\n"))
+		if !isPhpSlowlog(data) {
+			t.Fatal("Error slowlog not detected")
+		}
+		s, _ := parsePhpSlowlog(data)
+		if s.Script != "/var/www/public/index.php" || len(s.Frames) != 2 {
+			t.Errorf("got: %+v", s)
+		}
+	})
+
+	t.Run("slow scripts", func(t *testing.T) {
+		slowlogs := PhpSlowlogs{
+			{Script: "/a.php", Duration: "6"},
+			{Script: "/a.php", Duration: "1"},
+			{Script: "/a.php", Duration: "7"},
+			{Script: "/b.php", Duration: "9"},
+		}
+		scripts, counts := slowScripts(slowlogs, 2, 5)
+		if len(scripts) != 1 || scripts[0] != "/a.php" || counts["/a.php"] != 2 {
+			t.Errorf("got: %v %v\nwant: %v", scripts, counts, "/a.php 2 times")
+		}
+	})
+}
+
+func TestHandler(t *testing.T) {
+	sinks := newFakeSinks(t)
+	defer sinks.close()
+	os.Setenv("ES_NGINX_ERROR_INDEX", "nginx-error")
+	defer os.Unsetenv("ES_NGINX_ERROR_INDEX")
+
+	event := kinesisEvent("web-1",
+		`2019/08/23 15:37:26 [error] 123#0: *45 upstream timed out (110: Connection timed out) while reading response header from upstream, client: 1.2.3.4, server: example.com, request: "GET /api/users?id=1 HTTP/1.1", host: "example.com"`,
+		`[23-Aug-2019 06:37:26 UTC] PHP Fatal error:  Uncaught Exception: boom in /var/www/app.php:12`,
+		`Stack trace:`,
+		`#0 /var/www/index.php(3): run()`,
+		`[23-Aug-2019 06:37:27 UTC] PHP Notice:  Undefined index: id in /var/www/app.php on line 40`,
+	)
+	if err := handler(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+
+	if nginx := sinks.object(t, "nginx_error"); len(nginx) != 1 || nginx[0]["client"] != "1.2.3.4" {
+		t.Errorf("got: %v", nginx)
+	}
+	php := sinks.object(t, "php-fpm-error")
+	if len(php) != 2 || php[0]["time_stamp"] != "2019/08/23 06:37:26" || php[0]["@timestamp"] != "2019-08-23T06:37:26Z" {
+		t.Errorf("got: %v", php)
+	}
+
+	// php-fpm error log is not indexed without ES_PHP_ERROR_INDEX.
+	if len(sinks.docs) != 1 || sinks.docs[0].Index != "nginx-error" || sinks.docs[0].Source["message"] == "" {
+		t.Errorf("got: %+v", sinks.docs)
+	}
+
+	// the notice is archived but not notified.
+	if len(sinks.messages) != 2 || !strings.Contains(sinks.messages[0].Text, "upstream timed out") || !strings.Contains(sinks.messages[1].Text, "Uncaught Exception: boom") {
+		t.Errorf("got: %+v", sinks.messages)
+	}
+}
+
+func TestAlertSlowScripts(t *testing.T) {
+	sinks := newFakeSinks(t)
+	defer sinks.close()
+	os.Setenv("SLOWLOG_BATCH_ALERT_COUNT", "2")
+	defer os.Unsetenv("SLOWLOG_BATCH_ALERT_COUNT")
+
+	entry := "[23-Aug-2019 15:37:26]  [pool www] pid 123\nscript_filename = /var/www/public/index.php"
+
+	// the entries are counted per batch: one in each of two batches is
+	// not notified.
+	for i := 0; i < 2; i++ {
+		if err := handler(context.Background(), kinesisEvent("web-1", entry)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sinks.messages) != 0 {
+		t.Errorf("got: %+v\nwant: no message", sinks.messages)
+	}
+
+	if err := handler(context.Background(), kinesisEvent("web-1", entry, entry)); err != nil {
+		t.Fatal(err)
+	}
+	if len(sinks.messages) != 1 || sinks.messages[0].Text != "php-fpm slowlog: /var/www/public/index.php was slow 2 times" {
+		t.Errorf("got: %+v", sinks.messages)
+	}
+}
+
+func TestHandlerUnknownLines(t *testing.T) {
+	sinks := newFakeSinks(t)
+	defer sinks.close()
+
+	event := kinesisEvent("web-1",
+		`[23-Aug-2019 06:37:26 UTC] PHP Fatal error:  Uncaught Exception: boom in /var/www/app.php:12`,
+		`#0 /var/www/index.php(3): run()`,
+		`Segmentation fault (core dumped)`,
+		`{"nginx_error":"nginx_error","message":`,
+		`{"php-fpm-error":"php-fpm-error","message":`,
+		`{"php-fpm-slowlog":"php-fpm-slowlog","script":`,
+	)
+	if err := handler(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+
+	// the unknown line is a record of its own, the broken JSON is dropped.
+	php := sinks.object(t, "php-fpm-error")
+	if len(php) != 2 || len(php[0]["stack"].([]interface{})) != 1 || php[1]["message"] != "Segmentation fault (core dumped)" {
+		t.Errorf("got: %v", php)
+	}
+	if keys := sinks.keys(); len(keys) != 1 {
+		t.Errorf("got: %v\nwant: only php-fpm-error", keys)
+	}
+}
+
+func TestHandlerJunkLines(t *testing.T) {
+	sinks := newFakeSinks(t)
+	defer sinks.close()
+
+	event := kinesisEvent("web-1",
+		`   `,
+		`Segmentation fault (core dumped)`,
+		`hello from stdout`,
+		`[23-Aug-2019 06:37`,
+		`#0 /var/www/index.php(3): run()`,
+	)
+	if err := handler(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if len(sinks.messages) != 0 {
+		t.Errorf("got: %+v\nwant: no message", sinks.messages)
+	}
+	// the blank line is dropped, the stack line joins the truncated one.
+	if php := sinks.object(t, "php-fpm-error"); len(php) != 3 {
+		t.Errorf("got: %v\nwant: 3 records", php)
+	}
+}
+
+func TestHandlerDropped(t *testing.T) {
+	sinks := newFakeSinks(t)
+	defer sinks.close()
+
+	event := kinesisEvent("web-1",
+		`{"nginx_error":"nginx_error","time_stamp":"2019/08/23`,
+		`{"php-fpm-error":"php-fpm-error","time_stamp":`,
+		`[23-Aug-2019 06:37:26 UTC] PHP Warning:  Division by zero in /var/www/app.php on line 20`,
+	)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	org := os.Stdout
+	os.Stdout = w
+	err = handler(context.Background(), event)
+	os.Stdout = org
+	w.Close()
+	out, _ := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "dropped 2 undecodable records of 3"; !strings.Contains(string(out), want) {
+		t.Errorf("got: %s\nwant: %s", out, want)
+	}
+	if php := sinks.object(t, "php-fpm-error"); len(php) != 1 {
+		t.Errorf("got: %v\nwant: 1 record", php)
+	}
+}
+
+func TestReindex(t *testing.T) {
+	if os.Getenv("S3_ENDPOINT") != "" {
+		t.Skip("the archive is read from the in-memory S3")
+	}
+	sinks := newFakeSinks(t)
+	defer sinks.close()
+	for k, v := range map[string]string{
+		"ES_NGINX_ERROR_INDEX": "nginx-error",
+		"ES_PHP_ERROR_INDEX":   "php-fpm-error",
+		"REDACT_MODE":          "hash",
+		"REDACT_SALT":          "salt",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	event := kinesisEvent("web-1",
+		`2019/08/23 15:37:26 [error] 123#0: *45 open() failed, client: 1.2.3.4, server: example.com, request: "GET /?email=a@example.com HTTP/1.1", host: "example.com"`,
+		`[23-Aug-2019 06:37:26 UTC] PHP Fatal error:  Uncaught Exception: a@example.com in /var/www/app.php:12`,
+		`#0 /var/www/index.php(3): run()`,
+	)
+	if err := handler(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	live := sinks.docs
+	if len(live) != 2 || live[0].Id != event.Records[0].EventID || live[1].Id != event.Records[1].EventID {
+		t.Fatalf("got: %+v\nwant: the ids of the first lines", live)
+	}
+
+	for _, logname := range []string{"nginx_error", "php-fpm-error"} {
+		t.Run(logname, func(t *testing.T) {
+			var lines [][]byte
+			for k, b := range sinks.objects {
+				if strings.HasPrefix(k, "/"+logname+"/") {
+					lines = append(lines, bytes.Split(b, []byte("\n"))...)
+				}
+			}
+			// a rerun, e.g. after an interrupted run, overwrites the
+			// same documents, and redacted values are left as they are.
+			for i := 0; i < 2; i++ {
+				sinks.docs = nil
+				if err := reindex(context.Background(), logname, lines); err != nil {
+					t.Fatal(err)
+				}
+				var want []fakeDoc
+				for _, d := range live {
+					if d.Index == strings.Replace(logname, "_", "-", 1) {
+						want = append(want, d)
+					}
+				}
+				if !reflect.DeepEqual(sinks.docs, want) {
+					t.Errorf("got: %+v\nwant: %+v", sinks.docs, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReindexUnredacted(t *testing.T) {
+	sinks := newFakeSinks(t)
+	defer sinks.close()
+	os.Setenv("ES_PHP_ERROR_INDEX", "php-fpm-error")
+	defer os.Unsetenv("ES_PHP_ERROR_INDEX")
+
+	// archived before redaction.
+	raw, err := ioutil.ReadFile("testdata/senderrorlog/archived_php-fpm-error.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reindex(context.Background(), "php-fpm-error", bytes.Split(bytes.TrimSpace(raw), []byte("\n"))); err != nil {
+		t.Fatal(err)
+	}
+	if len(sinks.docs) != 1 {
+		t.Fatalf("got: %+v\nwant: 1 document", sinks.docs)
+	}
+	want := "Uncaught Exception: no user [REDACTED:email] in /var/www/app.php:12"
+	if got := sinks.docs[0].Source["message"]; got != want {
+		t.Errorf("got: %v\nwant: %v", got, want)
+	}
+}
+
+func TestGolden(t *testing.T) {
+	os.Setenv("ES_NGINX_ERROR_INDEX", "nginx-error")
+	os.Setenv("ES_PHP_ERROR_INDEX", "php-fpm-error")
+	os.Setenv("SLOWLOG_BATCH_ALERT_COUNT", "2")
+	defer os.Unsetenv("ES_NGINX_ERROR_INDEX")
+	defer os.Unsetenv("ES_PHP_ERROR_INDEX")
+	defer os.Unsetenv("SLOWLOG_BATCH_ALERT_COUNT")
+
+	testGolden(t, "testdata/senderrorlog", handler)
+}
+
+func TestMain(m *testing.M) {
+	os.Setenv("REGION", "ap-northeast-1")
+	os.Setenv("S3_BUCKET", getenv("S3_BUCKET", "test-bucket"))
+	os.Exit(m.Run())
+}
+
+func FuzzSenderrorlogHandler(f *testing.F) {
+	for _, r := range fixtureRecords(f, "testdata/senderrorlog/*.json") {
+		f.Add(r, []byte("Stack trace:"))
+	}
+	sinks := newFakeSinks(f)
+	defer sinks.close()
+
+	f.Fuzz(func(t *testing.T, a []byte, b []byte) {
+		sinks.objects = map[string][]byte{}
+		if err := handler(context.Background(), kinesisEvent("fuzz", string(a), string(b))); err != nil {
+			t.Fatal(err)
+		}
+		sinks.checkObjects(t)
+	})
+}
@@ -9,16 +9,15 @@ import (
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/aws/signer/v4"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/pkg/errors"
-	"github.com/sha1sum/aws_signing_client"
-	"gopkg.in/olivere/elastic.v6"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"reflect"
+	"sort"
 	"strings"
 	"time"
 )
@@ -43,20 +42,36 @@ type Nginx struct {
 	Forwardedfor           string `json:"forwardedfor"`
 	Request_time           string `json:"request_time"`
 	Upstream_response_time string `json:"upstream_response_time"`
+
+	// set by batch.enrich, batch.correlate and batch.normalizeRoutes
+	Trace_id  string            `json:"trace_id,omitempty"`
+	Client_ip string            `json:"client_ip,omitempty"`
+	Geo       *NginxGeo         `json:"geo,omitempty"`
+	Ua        *NginxUserAgent   `json:"ua,omitempty"`
+	Route     string            `json:"route,omitempty"`
+	Query     map[string]string `json:"query,omitempty"`
+
+	// Doc_id is the Elasticsearch _id, archived so that reprocess
+	// overwrites the documents indexed from Kinesis.
+	Doc_id string `json:"doc_id,omitempty"`
+
+	NormalizedTime
 }
 
 type Application struct {
-	Id         string   `json:"id"`
-	System     string   `json:"system"`
-	Level      string   `json:"level"`
-	Datetime   string   `json:"datetime"`
-	Env        string   `json:"env"`
-	Message    string   `json:"message"`
-	Code       string   `json:"code"`
-	Response   string   `json:"response"`
-	Trace      []string `json:"trace"`
-	Genre      string   `json:"genre"`
-	Parameters string   `json:"parameters"`
+	Id         string      `json:"id"`
+	System     string      `json:"system"`
+	Level      string      `json:"level"`
+	Datetime   string      `json:"datetime"`
+	Env        string      `json:"env"`
+	Message    string      `json:"message"`
+	Code       flexString  `json:"code"`
+	File       flexString  `json:"file,omitempty"`
+	Line       flexString  `json:"line,omitempty"`
+	Response   flexString  `json:"response"`
+	Trace      flexStrings `json:"trace"`
+	Genre      string      `json:"genre"`
+	Parameters flexString  `json:"parameters"`
 	Slack      struct {
 		Notification bool `json:"notification"`
 		Body         struct {
@@ -67,18 +82,180 @@ type Application struct {
 			Level       string `json:"Level"`
 		} `json:"body"`
 	} `json:"slack"`
-	Extra struct {
-		File       string `json:"file"`
-		Line       string `json:"line"`
-		Class      string `json:"class"`
-		Function   string `json:"function"`
-		ProcessIdi string `json:"process_id"`
-		URL        string `json:"url"`
-		IP         string `json:"ip"`
-		HttpMethod string `json:"http_method"`
-		Server     string `json:"server"`
-		Referrer   string `json:"referrer"`
-	} `json:"extra"`
+	Extra ApplicationExtra `json:"extra"`
+
+	// TraceId is read from APP_TRACE_FIELD by batch.correlate.
+	TraceId string `json:"trace_id,omitempty"`
+
+	// DocId is the archived Elasticsearch _id, as Nginx.Doc_id.
+	DocId string `json:"doc_id,omitempty"`
+
+	NormalizedTime
+
+	// Overflow keeps the fields this struct does not know, so that they
+	// are written to S3 and Elasticsearch as they came.
+	Overflow map[string]json.RawMessage `json:"-"`
+}
+
+type ApplicationExtra struct {
+	File       flexString `json:"file"`
+	Line       flexString `json:"line"`
+	Class      string     `json:"class"`
+	Function   string     `json:"function"`
+	ProcessIdi flexString `json:"process_id"`
+	URL        string     `json:"url"`
+	IP         string     `json:"ip"`
+	HttpMethod string     `json:"http_method"`
+	Server     string     `json:"server"`
+	Referrer   string     `json:"referrer"`
+	TraceId    string     `json:"trace_id,omitempty"`
+}
+
+// flexString accepts a string, number, bool or null, and keeps objects and
+// arrays as their JSON text. Laravel writes some fields either way.
+type flexString string
+
+func (f *flexString) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*f = flexString(s)
+		return nil
+	}
+	if string(b) == "null" {
+		*f = ""
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, b); err != nil {
+		return err
+	}
+	*f = flexString(buf.String())
+	return nil
+}
+
+// flexStrings accepts an array or a single value.
+type flexStrings []string
+
+func (f *flexStrings) UnmarshalJSON(b []byte) error {
+	// null is left as it is, so that an archived null stays null.
+	if string(b) == "null" {
+		return nil
+	}
+	var raws []json.RawMessage
+	if err := json.Unmarshal(b, &raws); err != nil {
+		var s flexString
+		if err := s.UnmarshalJSON(b); err != nil {
+			return err
+		}
+		*f = flexStrings{string(s)}
+		return nil
+	}
+
+	*f = make(flexStrings, 0, len(raws))
+	for _, raw := range raws {
+		var s flexString
+		if err := s.UnmarshalJSON(raw); err != nil {
+			return err
+		}
+		*f = append(*f, string(s))
+	}
+	return nil
+}
+
+// UnmarshalJSON also accepts extra as an array of one object.
+func (e *ApplicationExtra) UnmarshalJSON(b []byte) error {
+	type plain ApplicationExtra
+
+	var extras []plain
+	if err := json.Unmarshal(b, &extras); err == nil {
+		if len(extras) > 0 {
+			*e = ApplicationExtra(extras[0])
+		}
+		return nil
+	}
+
+	var p plain
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	*e = ApplicationExtra(p)
+	return nil
+}
+
+// applicationFields are the json keys of Application.
+var applicationFields = jsonFields(reflect.TypeOf(Application{}))
+
+// jsonFields returns the json keys of the struct, including the ones of
+// embedded structs.
+func jsonFields(t reflect.Type) map[string]bool {
+	fields := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Anonymous && name == "" {
+			for k := range jsonFields(f.Type) {
+				fields[k] = true
+			}
+			continue
+		}
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = true
+	}
+	return fields
+}
+
+// UnmarshalJSON keeps unknown fields in Overflow.
+func (a *Application) UnmarshalJSON(b []byte) error {
+	type plain Application
+
+	var p plain
+	err := json.Unmarshal(b, &p)
+	*a = Application(p)
+
+	var all map[string]json.RawMessage
+	if json.Unmarshal(b, &all) == nil {
+		for k, v := range all {
+			if !applicationFields[k] {
+				if a.Overflow == nil {
+					a.Overflow = map[string]json.RawMessage{}
+				}
+				a.Overflow[k] = v
+			}
+		}
+	}
+	return err
+}
+
+// MarshalJSON writes Overflow back next to the known fields.
+func (a Application) MarshalJSON() ([]byte, error) {
+	type plain Application
+
+	b, err := json.Marshal(plain(a))
+	if err != nil || len(a.Overflow) == 0 {
+		return b, err
+	}
+
+	keys := make([]string, 0, len(a.Overflow))
+	for k := range a.Overflow {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := bytes.NewBuffer(b[:len(b)-1])
+	for _, k := range keys {
+		name, _ := json.Marshal(k)
+		buf.WriteByte(',')
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(a.Overflow[k])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
 }
 
 type Nginxs []Nginx
@@ -124,23 +301,6 @@ func webhook(at_channel bool, channel string, message string) error {
 	return err
 }
 
-func elasticClient() (*elastic.Client, error) {
-
-	creds := credentials.NewEnvCredentials()
-	signer := v4.NewSigner(creds)
-
-	awsClient, err := aws_signing_client.New(signer, nil, "es", os.Getenv("REGION"))
-	if err != nil {
-		return nil, err
-	}
-	return elastic.NewClient(
-		elastic.SetURL(os.Getenv("ES_URL")),
-		elastic.SetScheme("https"),
-		elastic.SetHttpClient(awsClient),
-		elastic.SetSniff(false),
-	)
-}
-
 func createSession() *session.Session {
 
 	var sess = session.Must(session.NewSession(&aws.Config{
@@ -156,27 +316,32 @@ func split(r rune) bool {
 	return r == ':' || r == ' ' || r == '/'
 }
 
-// send logdata(json) to s3
-func s3Upload(buf bytes.Buffer, convertData []byte, logname string, hostname string) (*s3manager.UploadOutput, error) {
+// send logdata(json) to s3. The key is made of at and seq, the arrival time and sequence number of
+// the first record of the batch, so that a retried batch overwrites its
+// objects. A zero at is the current time.
+func s3Upload(buf bytes.Buffer, convertData []byte, logname string, hostname string, at time.Time, seq string) (*s3manager.UploadOutput, error) {
 
 	err := compress(&buf, []byte(convertData))
 	if err != nil {
 		return nil, errors.Wrap(err, "Error failed compress")
 	}
 
-	sess := createSession()
-
-	var uploader = s3manager.NewUploader(sess)
+	uploader := newUploader()
 
-	jst := time.FixedZone("Asia/Tokyo", 9*60*60)
-	t := time.Now().In(jst).Format("2006/01/02 15:04:05")
+	if at.IsZero() {
+		at = time.Now()
+	}
+	t := at.In(jst).Format("2006/01/02 15:04:05")
 	tmp := strings.FieldsFunc(t, split)
 
 	// if argument has hostname, function gives hostname to logname.
 	if hostname != "" {
 		hostname = hostname + "-"
 	}
-	path := "/" + logname + "/" + strings.Join(tmp[0:4], "/") + "/" + hostname + strings.Join(tmp, "") + "-" + logname + ".gz"
+	if seq != "" {
+		seq = "-" + seq
+	}
+	path := "/" + logname + "/" + strings.Join(tmp[0:4], "/") + "/" + hostname + strings.Join(tmp, "") + seq + "-" + logname + ".gz"
 
 	result, err := uploader.Upload(&s3manager.UploadInput{
 		Bucket: aws.String(os.Getenv("S3_BUCKET")),
@@ -199,205 +364,602 @@ func compress(w io.Writer, convertData []byte) error {
 }
 
 //For JSON lines (support athena JSON SerDe libraries)
+// One record per line; the records are marshaled as they are, so that
+// brackets and braces in the values are kept.
 func marshalAthena(v interface{}) ([]byte, error) {
-	vathena, err := json.Marshal(v)
-	vathena = bytes.ReplaceAll(vathena, []byte("[{"), []byte("{"))
-	vathena = bytes.ReplaceAll(vathena, []byte("},{"), []byte("},\n{"))
-	vathena = bytes.ReplaceAll(vathena, []byte("}]"), []byte("}"))
-	return vathena, err
-}
-
-// remove duplicate hostname
-func removeDuplicate(hostname []string) []string {
-	results := make([]string, 0, len(hostname))
-	encountered := map[string]bool{}
-	for i := 0; i < len(hostname); i++ {
-		if !encountered[hostname[i]] {
-			encountered[hostname[i]] = true
-			results = append(results, hostname[i])
-		}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var records []json.RawMessage
+	if err := json.Unmarshal(b, &records); err != nil {
+		return b, nil
+	}
+	lines := make([][]byte, len(records))
+	for i, r := range records {
+		lines[i] = r
+	}
+	return bytes.Join(lines, []byte("\n")), nil
+}
+
+// nginxGroupKeys are the partition keys selectable by NGINX_GROUP_BY.
+var nginxGroupKeys = map[string]func(Nginx) string{
+	"host":   func(v Nginx) string { return v.Host },
+	"status": func(v Nginx) string { return statusClass(v.Status) },
+	"api_id": func(v Nginx) string { return v.Amzn_agw_api_id },
+	"agent":  agentClass,
+}
+
+// applicationGroupKeys are the partition keys selectable by APP_GROUP_BY.
+var applicationGroupKeys = map[string]func(Application) string{
+	"none":   func(v Application) string { return "" },
+	"system": func(v Application) string { return v.System },
+	"level":  func(v Application) string { return strings.ToLower(v.Level) },
+	"env":    func(v Application) string { return v.Env },
+}
+
+// statusClass converts a status code to its class (e.g. 404 -> 4xx).
+func statusClass(status string) string {
+	if status == "" {
+		return ""
 	}
-	return results
+	return status[:1] + "xx"
 }
 
-// Filter returns a new slice containig hostname.
-func nginxsFilter(vs Nginxs, f func(string) bool) Nginxs {
-	vsf := make(Nginxs, 0)
+// nginxGroupKey looks up the key function named by NGINX_GROUP_BY.
+// An empty variable selects the default key.
+func nginxGroupKey() (func(Nginx) string, error) {
+	name := os.Getenv("NGINX_GROUP_BY")
+	if name == "" {
+		name = "host"
+	}
+	f, ok := nginxGroupKeys[name]
+	if !ok {
+		return nil, errors.Errorf("Error unknown NGINX_GROUP_BY %q", name)
+	}
+	return f, nil
+}
+
+// applicationGroupKey looks up the key function named by APP_GROUP_BY.
+func applicationGroupKey() (func(Application) string, error) {
+	name := os.Getenv("APP_GROUP_BY")
+	if name == "" {
+		name = "none"
+	}
+	f, ok := applicationGroupKeys[name]
+	if !ok {
+		return nil, errors.Errorf("Error unknown APP_GROUP_BY %q", name)
+	}
+	return f, nil
+}
+
+// groupBy partitions records by key in one pass.
+// Keys are returned sorted so the upload order does not depend on the batch.
+func groupBy[T any](vs []T, key func(T) string) ([]string, map[string][]T) {
+	groups := map[string][]T{}
+	keys := make([]string, 0)
 	for _, v := range vs {
-		if f(v.Host) {
-			vsf = append(vsf, v)
+		k := key(v)
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
 		}
+		groups[k] = append(groups[k], v)
 	}
-	return vsf
+	sort.Strings(keys)
+	return keys, groups
 }
 
-func handler(ctx context.Context, kinesisEvent events.KinesisEvent) error {
+// jst is the timezone of the S3 object path.
+var jst = time.FixedZone("Asia/Tokyo", 9*60*60)
 
-	var dataBytes []byte
-	var nginx Nginx
-	var nginxs Nginxs
-	var nginxtmp Nginxs
-	var application Application
-	var applications Applications
+// normalizeNginxs sets the normalized time of each access log and returns
+// the times for the index names.
+func normalizeNginxs(nginxs Nginxs) ([]time.Time, error) {
+	n, err := newTimeNormalizer()
+	if err != nil {
+		return nil, err
+	}
+
+	times := make([]time.Time, len(nginxs))
+	for i := range nginxs {
+		nginxs[i].NormalizedTime, times[i] = n.normalize(nginxs[i].Time, nginxTimeLayouts)
+	}
+	return times, nil
+}
+
+// normalizeApplications sets the normalized time of each laravel log.
+func normalizeApplications(applications Applications) ([]time.Time, error) {
+	n, err := newTimeNormalizer()
+	if err != nil {
+		return nil, err
+	}
+
+	times := make([]time.Time, len(applications))
+	for i := range applications {
+		applications[i].NormalizedTime, times[i] = n.normalize(applications[i].Datetime, applicationTimeLayouts)
+	}
+	return times, nil
+}
+
+// batch holds the records of one Kinesis event, split by log type.
+// The ids are the Kinesis record ids of the records at the same position.
+type batch struct {
+	nginxs         Nginxs
+	nginxIDs       []string
+	applications   Applications
+	applicationIDs []string
+
+	// dropped counts the records that could not be decoded.
+	dropped int
+
+	// arrival and seq of the first record name the S3 objects.
+	arrival time.Time
+	seq     string
+}
+
+// stage processes the records of one log type.
+// Every stage runs on each batch, whatever else the batch contains.
+type stage func(ctx context.Context, b batch) error
+
+var stages = []stage{nginxStage, applicationStage}
+
+// enrich sets the client ip, location and parsed user agent of every
+// access log.
+func (b batch) enrich(e *ipEnricher) {
+	for i := range b.nginxs {
+		e.enrich(&b.nginxs[i])
+		b.nginxs[i].Ua = parseUserAgent(b.nginxs[i].Useragent)
+	}
+}
+
+// normalizeRoutes sets the route template and parsed query of every
+// access log. It runs after redact, so the query holds masked values.
+func (b batch) normalizeRoutes(n *routeNormalizer) {
+	for i := range b.nginxs {
+		n.normalize(&b.nginxs[i])
+	}
+}
+
+// redact masks sensitive data in every record of the batch.
+func (b batch) redact(r *redactor) {
+	for i := range b.nginxs {
+		r.redact(&b.nginxs[i])
+	}
+	for i := range b.applications {
+		r.redact(&b.applications[i])
+	}
+}
+
+// applicationDocID returns the Elasticsearch _id of the laravel log.
+func applicationDocID(id string, v Application) string {
+	if id != "" && os.Getenv("ES_DOC_ID") != "content" {
+		return id
+	}
+	if v.Id != "" {
+		return v.Id
+	}
+	return contentID(v)
+}
+
+// decodeNginx reads a JSON or LTSV access log. LTSV labels are the json
+// keys of Nginx (time:...<TAB>host:...).
+func decodeNginx(data []byte, v *Nginx) error {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("{")) {
+		return json.Unmarshal(data, v)
+	}
+
+	// a field without a label is skipped, the rest is kept.
+	fields := map[string]string{}
+	for _, field := range strings.Split(string(data), "\t") {
+		kv := strings.SplitN(field, ":", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// decodeRecords detects the log type of each Kinesis record. Records that
+// do not decode are logged, counted and dropped.
+func decodeRecords(kinesisEvent events.KinesisEvent) batch {
+	var b batch
+	if len(kinesisEvent.Records) > 0 {
+		first := kinesisEvent.Records[0].Kinesis
+		b.arrival, b.seq = first.ApproximateArrivalTimestamp.Time, first.SequenceNumber
+	}
 
 	for _, record := range kinesisEvent.Records {
-		kinesisRecord := record.Kinesis
-		dataBytes = kinesisRecord.Data
+		dataBytes := record.Kinesis.Data
 
 		// Extract substring from KinesisRecord
-		if bytes.Contains(dataBytes, []byte("forwardedfor")) == true {
-			json.Unmarshal(dataBytes, &nginx)
-			nginxs = append(nginxs, nginx)
-		} else if bytes.Contains(dataBytes, []byte("extra")) == true {
-			json.Unmarshal(dataBytes, &application)
-			fmt.Println(application)
-			applications = append(applications, application)
+		if bytes.Contains(dataBytes, []byte("forwardedfor")) {
+			var nginx Nginx
+			err := decodeNginx(dataBytes, &nginx)
+			if err != nil {
+				fmt.Println("Error failed to decode nginx log", record.EventID, err)
+				b.dropped++
+				continue
+			}
+			b.nginxs = append(b.nginxs, nginx)
+			b.nginxIDs = append(b.nginxIDs, kinesisID(record))
+		} else if bytes.Contains(dataBytes, []byte("extra")) {
+			var application Application
+			err := json.Unmarshal(dataBytes, &application)
+			if err != nil {
+				fmt.Println("Error failed to decode application log", record.EventID, err)
+				b.dropped++
+				continue
+			}
+			b.applications = append(b.applications, application)
+			b.applicationIDs = append(b.applicationIDs, kinesisID(record))
 		}
 	}
+	return b
+}
+
+// nginx log processing
+func nginxStage(ctx context.Context, b batch) error {
+	nginxs := b.nginxs
+	if nginxs == nil {
+		return nil
+	}
 
-	// nginx log processing
-	if nginxs != nil {
-		var nginxbuf bytes.Buffer
-		var hostnameList []string
-		var hostnameUniqueList []string
+	var nginxbuf bytes.Buffer
 
-		for _, tmp := range nginxs {
-			hostnameList = append(hostnameList, tmp.Host)
+	times, err := normalizeNginxs(nginxs)
+	if err != nil {
+		return err
+	}
+	for i := range nginxs {
+		nginxs[i].Doc_id = docID(b.nginxIDs[i], nginxs[i])
+	}
+
+	key, err := nginxGroupKey()
+	if err != nil {
+		return err
+	}
+
+	// sort access log by group key (hostname by default).
+	keys, groups := groupBy(nginxs, key)
+	for _, k := range keys {
+		nginxsjson, _ := marshalAthena(groups[k])
+		_, err := s3Upload(nginxbuf, nginxsjson, "nginx_access", k, b.arrival, b.seq)
+		if err != nil {
+			return errors.Wrap(err, "Error failed to s3 upload")
 		}
+	}
 
-		hostnameUniqueList = removeDuplicate(hostnameList)
+	return indexNginxs(ctx, b, times)
+}
 
-		// sort access log by hostname.
-		for _, tmp := range hostnameUniqueList {
-			nginxtmp = nginxsFilter(nginxs, func(v string) bool {
-				return v == tmp
-			})
-			nginxsjson, _ := marshalAthena(nginxtmp)
-			_, err := s3Upload(nginxbuf, nginxsjson, "nginx_access", tmp)
-			if err != nil {
-				return errors.Wrap(err, "Error failed to s3 upload")
-			}
+// indexNginxs sends the access logs to ES_NGINX_INDEX.
+func indexNginxs(ctx context.Context, b batch, times []time.Time) error {
+	nginxs := b.nginxs
+
+	sink, err := newESSink()
+	if err != nil {
+		return errors.Wrap(err, "Error failed to elasticsearch access")
+	}
+
+	// for elasticsearch data structure
+	docs := make([]esDoc, 0, len(nginxs))
+	for i, tmp := range nginxs {
+		accessdata := Nginx{
+			Time:                   tmp.Time,
+			Remote_addr:            tmp.Remote_addr,
+			Host:                   tmp.Host,
+			Request_method:         tmp.Request_method,
+			Request_length:         tmp.Request_length,
+			Request_uri:            tmp.Request_uri,
+			Https:                  tmp.Https,
+			Uri:                    tmp.Uri,
+			Query_string:           tmp.Query_string,
+			Status:                 tmp.Status,
+			Bytes_sent:             tmp.Bytes_sent,
+			Body_bytes_sent:        tmp.Body_bytes_sent,
+			Referer:                tmp.Referer,
+			Useragent:              tmp.Useragent,
+			Amzn_trace_id:          tmp.Amzn_trace_id,
+			Amzn_agw_api_id:        tmp.Amzn_agw_api_id,
+			Forwardedfor:           tmp.Forwardedfor,
+			Request_time:           tmp.Request_time,
+			Upstream_response_time: tmp.Upstream_response_time,
+			Trace_id:               tmp.Trace_id,
+			Client_ip:              tmp.Client_ip,
+			Geo:                    tmp.Geo,
+			Ua:                     tmp.Ua,
+			Route:                  tmp.Route,
+			Query:                  tmp.Query,
+			NormalizedTime:         tmp.NormalizedTime,
 		}
 
-		cli, err := elasticClient()
+		// ES_NGINX_INDEX is a write alias or a pattern such as nginx-access-%Y.%m.%d
+		id := tmp.Doc_id
+		if id == "" {
+			id = docID(b.nginxIDs[i], tmp)
+		}
+		docs = append(docs, esDoc{
+			Id:    id,
+			Index: indexName(os.Getenv("ES_NGINX_INDEX"), timeOrNow(times[i])),
+			Type:  os.Getenv("ES_NGINX_INDEXTYPE"),
+			Body:  accessdata,
+		})
+	}
+	return sink.Index(ctx, docs)
+}
+
+// laravel log processing
+func applicationStage(ctx context.Context, b batch) error {
+	applications := b.applications
+	if applications == nil {
+		return nil
+	}
+
+	var applicationbuf bytes.Buffer
+
+	times, err := normalizeApplications(applications)
+	if err != nil {
+		return err
+	}
+	for i := range applications {
+		applications[i].DocId = applicationDocID(b.applicationIDs[i], applications[i])
+	}
+
+	key, err := applicationGroupKey()
+	if err != nil {
+		return err
+	}
+
+	keys, groups := groupBy(applications, key)
+	for _, k := range keys {
+		applicationsjson, _ := marshalAthena(groups[k])
+		_, err := s3Upload(applicationbuf, applicationsjson, "application", k, b.arrival, b.seq)
 		if err != nil {
-			return errors.Wrap(err, "Error failed to elasticsearch access")
+			return errors.Wrap(err, "Error failed to s3 upload")
 		}
+	}
 
-		// for elasticsearch data structure
-		for _, tmp := range nginxs {
-			accessdata := Nginx{
-				Time:                   tmp.Time,
-				Remote_addr:            tmp.Remote_addr,
-				Host:                   tmp.Host,
-				Request_method:         tmp.Request_method,
-				Request_length:         tmp.Request_length,
-				Request_uri:            tmp.Request_uri,
-				Https:                  tmp.Https,
-				Uri:                    tmp.Uri,
-				Query_string:           tmp.Query_string,
-				Status:                 tmp.Status,
-				Bytes_sent:             tmp.Bytes_sent,
-				Body_bytes_sent:        tmp.Body_bytes_sent,
-				Referer:                tmp.Referer,
-				Useragent:              tmp.Useragent,
-				Amzn_trace_id:          tmp.Amzn_trace_id,
-				Amzn_agw_api_id:        tmp.Amzn_agw_api_id,
-				Forwardedfor:           tmp.Forwardedfor,
-				Request_time:           tmp.Request_time,
-				Upstream_response_time: tmp.Upstream_response_time,
-			}
+	return indexApplications(ctx, b, times)
+}
 
-			_, err = cli.Index().Index(os.Getenv("ES_NGINX_INDEX")).Type(os.Getenv("ES_NGINX_INDEXTYPE")).
-				BodyJson(accessdata).
-				Do(ctx)
+// notifyApplications sends the laravel logs flagged for Slack. It runs
+// after every stage succeeded, so that a retried batch does not notify
+// twice.
+func notifyApplications(b batch) error {
+	for _, record := range b.applications {
+
+		// Flag on, send notify.
+		if record.Slack.Notification {
+			message := record.Slack.Body.Message
+			if link := traceLink(record.TraceId); link != "" {
+				message += "\n" + link
+			}
+			err := webhook(record.Slack.Body.AtChannel, record.Slack.Body.SendChannel, message)
 			if err != nil {
-				return errors.Wrap(err, "Error failed to elasticsearch PUT")
+				return errors.Wrap(err, "Error failed to send application notification to slack")
 			}
 		}
+	}
+	return nil
+}
+
+// indexApplications sends the laravel logs to ES_APP_INDEX.
+func indexApplications(ctx context.Context, b batch, times []time.Time) error {
+	applications := b.applications
 
+	sink, err := newESSink()
+	if err != nil {
+		return errors.Wrap(err, "Error failed to elasticsearch access")
+	}
 
-	  // laravel log processing
-		if applications != nil {
-			var applicationbuf bytes.Buffer
+	// for elasticsearch data structure
+	docs := make([]esDoc, 0, len(applications))
+	for i, k := range applications {
+		id := k.DocId
+		if id == "" {
+			id = applicationDocID(b.applicationIDs[i], k)
+		}
+		esdata := Application{
+			Id:         k.Id,
+			System:     k.System,
+			Level:      k.Level,
+			Datetime:   k.Datetime,
+			Env:        k.Env,
+			Message:    k.Message,
+			Code:       k.Code,
+			File:       k.File,
+			Line:       k.Line,
+			Response:   k.Response,
+			Trace:      k.Trace,
+			Genre:      k.Genre,
+			Parameters: k.Parameters,
+			Slack:      k.Slack,
+			Extra:      k.Extra,
+			TraceId:    k.TraceId,
+
+			NormalizedTime: k.NormalizedTime,
+			Overflow:       k.Overflow,
+		}
 
-			for _, record := range applications {
+		// ES_APP_INDEX is the write alias installed by esbootstrap or a
+		// time-based index pattern.
+		docs = append(docs, esDoc{
+			Id:    id,
+			Index: indexName(os.Getenv("ES_APP_INDEX"), timeOrNow(times[i])),
+			Type:  os.Getenv("ES_APP_INDEXTYPE"),
+			Body:  esdata,
+		})
+	}
+	return sink.Index(ctx, docs)
+}
 
-				// Flag on, send notify.
-				if record.Slack.Notification {
-					err := webhook(record.Slack.Body.AtChannel, record.Slack.Body.SendChannel, record.Slack.Body.Message)
-					if err != nil {
-						return errors.Wrap(err, "Error failed to send application notification to slack")
-					}
-				}
+// prepareArchived refreshes the derived fields of archived records and
+// masks them. Objects archived before redaction and ip anonymization hold
+// the raw values; masking is idempotent, so the others are left as they
+// are. The location is only looked up when it is missing.
+func (b batch) prepareArchived() error {
+	e, err := newIPEnricher()
+	if err != nil {
+		return err
+	}
+	for i := range b.nginxs {
+		v := &b.nginxs[i]
+		if v.Client_ip == "" {
+			// archived before the client ip was derived.
+			e.enrich(v)
+		} else if ip := net.ParseIP(v.Client_ip); ip != nil {
+			if v.Geo == nil && e.geo != nil {
+				v.Geo = e.geo.lookup(ip)
 			}
+			v.Client_ip = e.anonymize(ip)
+		}
+		if e.mode != anonymizeOff {
+			v.Remote_addr = e.anonymizeList(v.Remote_addr)
+			v.Forwardedfor = e.anonymizeList(v.Forwardedfor)
+		}
+		v.Ua = parseUserAgent(v.Useragent)
+	}
+	b.correlate(traceFields())
 
-			applicationsjson, _ := marshalAthena(applications)
-			_, err := s3Upload(applicationbuf, applicationsjson, "application", "")
-			if err != nil {
-				return errors.Wrap(err, "Error failed to s3 upload")
-			}
+	r, err := newRedactor()
+	if err != nil {
+		return err
+	}
+	b.redact(r)
 
-			cli, err := elasticClient()
-			if err != nil {
-				return errors.Wrap(err, "Error failed to elasticsearch access")
-			}
+	n, err := newRouteNormalizer()
+	if err != nil {
+		return err
+	}
+	b.normalizeRoutes(n)
+	return nil
+}
 
-			// for elasticsearch data structure
-			for _, k := range applications {
-				k.Datetime = k.Datetime + "+09:00" // adjust elasticsearch timezone
-				esdata := Application{
-					Id:         k.Id,
-					System:     k.System,
-					Level:      k.Level,
-					Datetime:   k.Datetime,
-					Env:        k.Env,
-					Message:    k.Message,
-					Code:       k.Code,
-					Response:   k.Response,
-					Trace:      k.Trace,
-					Genre:      k.Genre,
-					Parameters: k.Parameters,
-					Slack:      k.Slack,
-					Extra:      k.Extra,
-				}
+// prepare enriches, masks and normalizes the records of the batch.
+func (b batch) prepare() error {
+	// the location is looked up from the real client ip, before the ip
+	// is anonymized or redacted.
+	e, err := newIPEnricher()
+	if err != nil {
+		return err
+	}
+	b.enrich(e)
+	b.correlate(traceFields())
 
-				// laravel logs datetime types is unmatched Elasticsearch dynamic mappings.
-				mapping := fmt.Sprintf(`{
-					"mappings": {
-						"%s": {
-							"properties": {
-								"datetime": {
-									"type": "date",
-									"format": "yyyy-MM-dd HH:mm:ssZ"
-								}
-							}
-						}
-					}
-				}`, os.Getenv("ES_APP_INDEXTYPE"))
-
-				// In case creating Elasticsearch index, define mapping first.
-				// (dynamic mapping not working)
-				exists, err := cli.IndexExists(os.Getenv("ES_APP_INDEX")).Do(ctx)
-				if !exists {
-					_, err = cli.CreateIndex(os.Getenv("ES_APP_INDEX")).BodyString(mapping).Do(ctx)
-					if err != nil {
-						return errors.Wrap(err, "Error failed to elasticsearch PUT")
-					}
-				}
+	// mask sensitive data before any sink sees the records.
+	r, err := newRedactor()
+	if err != nil {
+		return err
+	}
+	b.redact(r)
 
-				_, err = cli.Index().Index(os.Getenv("ES_APP_INDEX")).Type(os.Getenv("ES_APP_INDEXTYPE")).
-					BodyJson(esdata).
-					Do(ctx)
-				if err != nil {
-					return errors.Wrap(err, "Error failed to elasticsearch PUT")
-				}
+	n, err := newRouteNormalizer()
+	if err != nil {
+		return err
+	}
+	b.normalizeRoutes(n)
+	return nil
+}
+
+// reindex decodes archived access or laravel logs and indexes them again
+// under their archived document ids, or under content ids when they were
+// archived without one.
+func reindex(ctx context.Context, logname string, lines [][]byte) error {
+	var b batch
+	for _, line := range lines {
+		switch logname {
+		case "nginx_access":
+			var nginx Nginx
+			if err := json.Unmarshal(line, &nginx); err != nil {
+				fmt.Println("Error failed to decode nginx log", err)
+				continue
+			}
+			b.nginxs = append(b.nginxs, nginx)
+			b.nginxIDs = append(b.nginxIDs, "")
+		case "application":
+			var application Application
+			if err := json.Unmarshal(line, &application); err != nil {
+				fmt.Println("Error failed to decode application log", err)
+				continue
 			}
+			b.applications = append(b.applications, application)
+			b.applicationIDs = append(b.applicationIDs, "")
+		default:
+			return errors.Errorf("Error unknown logname %q", logname)
+		}
+	}
+	if err := b.prepareArchived(); err != nil {
+		return err
+	}
+
+	if b.nginxs != nil {
+		times, err := normalizeNginxs(b.nginxs)
+		if err != nil {
+			return err
+		}
+		if err := indexNginxs(ctx, b, times); err != nil {
+			return err
+		}
+	}
+	if b.applications != nil {
+		times, err := normalizeApplications(b.applications)
+		if err != nil {
+			return err
+		}
+		if err := indexApplications(ctx, b, times); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+func handler(ctx context.Context, kinesisEvent events.KinesisEvent) error {
+
+	b := decodeRecords(kinesisEvent)
+	if b.dropped > 0 {
+		fmt.Printf("dropped %d undecodable records of %d\n", b.dropped, len(kinesisEvent.Records))
+	}
+	if err := b.prepare(); err != nil {
+		return err
+	}
+
+	// A failing stage does not stop the others; the first error is
+	// returned so that Lambda retries the batch. The retry overwrites the
+	// S3 objects and documents of the stages that succeeded, and Slack is
+	// notified only once every stage succeeded.
+	var firstErr error
+	for _, s := range stages {
+		if err := s(ctx, b); err != nil {
+			fmt.Println(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return notifyApplications(b)
+}
+
 func main() {
+	if !isLambda() {
+		var err error
+		if len(os.Args) > 1 && os.Args[1] == "reprocess" {
+			err = runReprocess(context.Background(), os.Args[2:], reindex)
+		} else {
+			err = runKinesis(os.Args[1:], os.Stdin, os.Stdout, handler)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 	lambda.Start(handler)
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Known timestamp layouts of each log type. Layouts without offset are
+// read in LOG_TIMEZONE.
+var (
+	nginxTimeLayouts = []string{
+		time.RFC3339,
+		"02/Jan/2006:15:04:05 -0700",
+	}
+	applicationTimeLayouts = []string{
+		"2006-01-02 15:04:05",
+		"2006-01-02 15:04:05.999999",
+		"2006-01-02 15:04:05Z07:00",
+		time.RFC3339Nano,
+	}
+	nginxErrorTimeLayouts = []string{
+		"2006/01/02 15:04:05",
+	}
+	// A trailing zone is split off by normalizeZoned.
+	phpErrorTimeLayouts = []string{
+		"02-Jan-2006 15:04:05",
+		"02-Jan-2006 15:04:05.999999",
+		"2006/01/02 15:04:05",
+	}
+)
+
+// NormalizedTime is the record time in RFC3339 UTC, added to every record
+// next to its own time field.
+type NormalizedTime struct {
+	Utc      string `json:"@timestamp,omitempty"`
+	Original string `json:"time_original,omitempty"`
+	Unparsed bool   `json:"time_unparsed,omitempty"`
+}
+
+// timeNormalizer parses timestamps in the source timezone.
+type timeNormalizer struct {
+	loc *time.Location
+}
+
+var offsetPattern = regexp.MustCompile(`^([+-])(\d{2}):?(\d{2})$`)
+
+// loadLocation reads a zone name (Asia/Tokyo) or an offset (+09:00).
+// Lambda has no zoneinfo, so Asia/Tokyo and UTC work without it.
+func loadLocation(name string) (*time.Location, error) {
+	if m := offsetPattern.FindStringSubmatch(name); m != nil {
+		var h, min int
+		fmt.Sscanf(m[2]+" "+m[3], "%d %d", &h, &min)
+		offset := h*60*60 + min*60
+		if m[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(name, offset), nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err == nil {
+		return loc, nil
+	}
+	if strings.EqualFold(name, "Asia/Tokyo") || strings.EqualFold(name, "JST") {
+		return time.FixedZone("Asia/Tokyo", 9*60*60), nil
+	}
+	return nil, errors.Wrap(err, "Error unknown LOG_TIMEZONE")
+}
+
+// newTimeNormalizer reads the source timezone from LOG_TIMEZONE.
+func newTimeNormalizer() (*timeNormalizer, error) {
+	loc, err := loadLocation(getenv("LOG_TIMEZONE", "Asia/Tokyo"))
+	if err != nil {
+		return nil, err
+	}
+	return &timeNormalizer{loc: loc}, nil
+}
+
+// normalize parses value with the first matching layout. A value that no
+// layout matches is flagged as unparsed and returned with the zero time;
+// the original string is kept either way.
+func (n *timeNormalizer) normalize(value string, layouts []string) (NormalizedTime, time.Time) {
+	nt := NormalizedTime{Original: value}
+
+	value = strings.TrimSpace(value)
+	for _, layout := range layouts {
+		t, err := time.ParseInLocation(layout, value, n.loc)
+		if err == nil {
+			nt.Utc = t.UTC().Format(time.RFC3339)
+			return nt, t
+		}
+	}
+
+	nt.Unparsed = true
+	fmt.Printf("unparsed time %q\n", value)
+	return nt, time.Time{}
+}
+
+var zoneSuffixPattern = regexp.MustCompile(`^(.*\d) ([A-Za-z][\w/+-]*)$`)
+
+// normalizeZoned is normalize for values that may end with a zone, as PHP
+// writes its date.timezone (UTC, Asia/Tokyo). The value is read in that
+// zone, and in LOG_TIMEZONE only when it has none. A zone that does not
+// load leaves the value unparsed.
+func (n *timeNormalizer) normalizeZoned(value string, layouts []string) (NormalizedTime, time.Time) {
+	m := zoneSuffixPattern.FindStringSubmatch(strings.TrimSpace(value))
+	if m == nil {
+		return n.normalize(value, layouts)
+	}
+
+	loc, err := loadLocation(m[2])
+	if err != nil {
+		fmt.Printf("unparsed time %q: unknown zone\n", value)
+		return NormalizedTime{Original: value, Unparsed: true}, time.Time{}
+	}
+	nt, t := (&timeNormalizer{loc: loc}).normalize(m[1], layouts)
+	nt.Original = value
+	return nt, t
+}
+
+// timeOrNow returns t, or now for an unparsed time.
+func timeOrNow(t time.Time) time.Time {
+	if t.IsZero() {
+		return time.Now()
+	}
+	return t
+}
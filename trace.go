@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// traceRootPattern is an X-Ray trace id, e.g. 1-5d36ab26-8a61c1cb8a4ae3503e77f20d.
+var traceRootPattern = regexp.MustCompile(`1-[0-9a-fA-F]{8}-[0-9a-fA-F]{24}`)
+
+// traceID normalizes an X-Amzn-Trace-Id header ("Root=1-...;Parent=...;Sampled=1",
+// "Self=...;Root=...") or a bare id to the Root trace id. Any other id is
+// kept as it is, so that applications can use their own request ids.
+func traceID(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "-" {
+		return ""
+	}
+	for _, part := range strings.Split(s, ";") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 && kv[0] == "Root" {
+			return kv[1]
+		}
+	}
+	if id := traceRootPattern.FindString(s); id != "" {
+		return id
+	}
+	return s
+}
+
+// traceFields are the json paths of the trace id in a laravel log,
+// selectable by APP_TRACE_FIELD. The first one set is used.
+func traceFields() []string {
+	return splitList(getenv("APP_TRACE_FIELD", "trace_id,extra.trace_id,context.trace_id"))
+}
+
+// lookupField returns the string at the json path of the record, e.g.
+// context.trace_id. Unknown fields kept in Overflow are found as well.
+func lookupField(v interface{}, path string) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	var value interface{}
+	if json.Unmarshal(b, &value) != nil {
+		return ""
+	}
+	for _, k := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = obj[k]
+	}
+	s, _ := value.(string)
+	return s
+}
+
+// correlate sets the trace id of every record, so that an access log and
+// the laravel logs of the same request share it.
+func (b batch) correlate(fields []string) {
+	for i := range b.nginxs {
+		b.nginxs[i].Trace_id = traceID(b.nginxs[i].Amzn_trace_id)
+	}
+	for i := range b.applications {
+		for _, f := range fields {
+			if id := traceID(lookupField(b.applications[i], f)); id != "" {
+				b.applications[i].TraceId = id
+				break
+			}
+		}
+	}
+}
+
+// traceLink returns the Slack link to the trace, or "". TRACE_URL
+// replaces {trace_id}; the X-Ray console of REGION is the default.
+func traceLink(id string) string {
+	if id == "" {
+		return ""
+	}
+	u := os.Getenv("TRACE_URL")
+	if u == "" {
+		region := os.Getenv("REGION")
+		if region == "" || !traceRootPattern.MatchString(id) {
+			return ""
+		}
+		u = "https://" + region + ".console.aws.amazon.com/cloudwatch/home?region=" + region + "#xray:traces/{trace_id}"
+	}
+	return "<" + strings.Replace(u, "{trace_id}", id, -1) + "|trace " + id + ">"
+}
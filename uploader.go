@@ -0,0 +1,16 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3Uploader stores the archive objects. *s3manager.Uploader implements it.
+type s3Uploader interface {
+	Upload(input *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error)
+}
+
+// newUploader returns the uploader of S3_BUCKET (or of S3_ENDPOINT, e.g.
+// a local MinIO). Tests replace it with an in-memory store.
+var newUploader = func() s3Uploader {
+	return s3manager.NewUploader(createSession())
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// NginxUserAgent is the parsed Useragent of an access log.
+type NginxUserAgent struct {
+	Browser         string `json:"browser,omitempty"`
+	Browser_version string `json:"browser_version,omitempty"`
+	Os              string `json:"os,omitempty"`
+	Os_version      string `json:"os_version,omitempty"`
+	Device          string `json:"device"` // desktop, mobile, tablet, bot or unknown
+	Bot             bool   `json:"bot"`
+	Bot_class       string `json:"bot_class,omitempty"` // crawler, scanner, tool or monitor
+	Bot_name        string `json:"bot_name,omitempty"`
+}
+
+// uaRule names the user agents its pattern matches. The first submatch,
+// if any, is the version.
+type uaRule struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// uaBotRules are checked in order, so the generic crawler rule is last.
+var uaBotRules = []struct {
+	class string
+	rules []uaRule
+}{
+	{"scanner", []uaRule{
+		{"zgrab", regexp.MustCompile(`(?i)zgrab`)},
+		{"masscan", regexp.MustCompile(`(?i)masscan`)},
+		{"nmap", regexp.MustCompile(`(?i)nmap`)},
+		{"nikto", regexp.MustCompile(`(?i)nikto`)},
+		{"sqlmap", regexp.MustCompile(`(?i)sqlmap`)},
+		{"nuclei", regexp.MustCompile(`(?i)nuclei`)},
+		{"wpscan", regexp.MustCompile(`(?i)wpscan`)},
+		{"censys", regexp.MustCompile(`(?i)censys`)},
+		{"expanse", regexp.MustCompile(`(?i)expanse`)},
+		{"l9explore", regexp.MustCompile(`(?i)l9explore|l9tcpid`)},
+		{"nessus", regexp.MustCompile(`(?i)nessus`)},
+		{"acunetix", regexp.MustCompile(`(?i)acunetix`)},
+		{"zmeu", regexp.MustCompile(`(?i)zmeu`)},
+	}},
+	{"monitor", []uaRule{
+		{"elb", regexp.MustCompile(`ELB-HealthChecker`)},
+		{"route53", regexp.MustCompile(`Amazon-Route53-Health-Check-Service`)},
+		{"kube-probe", regexp.MustCompile(`kube-probe`)},
+		{"pingdom", regexp.MustCompile(`(?i)pingdom`)},
+		{"uptimerobot", regexp.MustCompile(`(?i)uptimerobot`)},
+		{"statuscake", regexp.MustCompile(`(?i)statuscake`)},
+		{"datadog", regexp.MustCompile(`(?i)datadog`)},
+		{"newrelic", regexp.MustCompile(`(?i)newrelicpinger`)},
+	}},
+	{"crawler", []uaRule{
+		{"googlebot", regexp.MustCompile(`Googlebot`)},
+		{"bingbot", regexp.MustCompile(`bingbot`)},
+		{"baiduspider", regexp.MustCompile(`Baiduspider`)},
+		{"yandexbot", regexp.MustCompile(`YandexBot`)},
+		{"duckduckbot", regexp.MustCompile(`DuckDuckBot`)},
+		{"applebot", regexp.MustCompile(`Applebot`)},
+		{"facebook", regexp.MustCompile(`facebookexternalhit`)},
+		{"twitterbot", regexp.MustCompile(`Twitterbot`)},
+		{"ahrefsbot", regexp.MustCompile(`AhrefsBot`)},
+		{"semrushbot", regexp.MustCompile(`SemrushBot`)},
+		{"mj12bot", regexp.MustCompile(`MJ12bot`)},
+		{"petalbot", regexp.MustCompile(`PetalBot`)},
+		{"bytespider", regexp.MustCompile(`Bytespider`)},
+		{"gptbot", regexp.MustCompile(`GPTBot`)},
+	}},
+	{"tool", []uaRule{
+		{"curl", regexp.MustCompile(`^curl/`)},
+		{"wget", regexp.MustCompile(`(?i)^wget/`)},
+		{"python", regexp.MustCompile(`python-requests|Python-urllib|aiohttp|httpx`)},
+		{"go", regexp.MustCompile(`Go-http-client`)},
+		{"java", regexp.MustCompile(`^Java/|Apache-HttpClient|okhttp`)},
+		{"perl", regexp.MustCompile(`libwww-perl`)},
+		{"node", regexp.MustCompile(`axios|node-fetch|undici`)},
+		{"headless", regexp.MustCompile(`HeadlessChrome|PhantomJS`)},
+	}},
+	{"crawler", []uaRule{
+		{"other", regexp.MustCompile(`(?i)bot\b|crawler|spider`)},
+	}},
+}
+
+// uaBrowserRules are checked in order: Edge and Opera also say Chrome,
+// Chrome also says Safari.
+var uaBrowserRules = []uaRule{
+	{"Edge", regexp.MustCompile(`Edg(?:e|A|iOS)?/([\d.]+)`)},
+	{"Opera", regexp.MustCompile(`OPR/([\d.]+)`)},
+	{"Samsung Internet", regexp.MustCompile(`SamsungBrowser/([\d.]+)`)},
+	{"Chrome", regexp.MustCompile(`(?:Chrome|CriOS)/([\d.]+)`)},
+	{"Firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/([\d.]+)`)},
+	{"Safari", regexp.MustCompile(`Version/([\d.]+).*Safari/`)},
+	{"IE", regexp.MustCompile(`MSIE ([\d.]+)|Trident/.*rv:([\d.]+)`)},
+}
+
+var uaOsRules = []uaRule{
+	{"Windows", regexp.MustCompile(`Windows NT ([\d.]+)`)},
+	{"iOS", regexp.MustCompile(`(?:iPhone|iPad|iPod).*? OS ([\d_]+)`)},
+	{"Android", regexp.MustCompile(`Android ?([\d.]*)`)},
+	{"Chrome OS", regexp.MustCompile(`CrOS`)},
+	{"macOS", regexp.MustCompile(`Mac OS X ?([\d_.]*)`)},
+	{"Linux", regexp.MustCompile(`Linux`)},
+}
+
+var (
+	uaTablet = regexp.MustCompile(`iPad|Tablet`)
+	uaMobile = regexp.MustCompile(`Mobi|iPhone|iPod`)
+)
+
+// matchUA returns the name and version of the first matching rule.
+func matchUA(rules []uaRule, s string) (string, string, bool) {
+	for _, r := range rules {
+		m := r.pattern.FindStringSubmatch(s)
+		if m == nil {
+			continue
+		}
+		version := ""
+		for _, v := range m[1:] {
+			if v != "" {
+				version = strings.Replace(v, "_", ".", -1)
+				break
+			}
+		}
+		return r.name, version, true
+	}
+	return "", "", false
+}
+
+// parseUserAgent classifies the user agent with the rules above. nginx
+// writes "-" for a missing header.
+func parseUserAgent(s string) *NginxUserAgent {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "-" {
+		return &NginxUserAgent{Device: "unknown"}
+	}
+
+	ua := &NginxUserAgent{}
+	ua.Browser, ua.Browser_version, _ = matchUA(uaBrowserRules, s)
+	ua.Os, ua.Os_version, _ = matchUA(uaOsRules, s)
+
+	for _, b := range uaBotRules {
+		if name, _, ok := matchUA(b.rules, s); ok {
+			ua.Bot, ua.Bot_class, ua.Bot_name = true, b.class, name
+			ua.Device = "bot"
+			return ua
+		}
+	}
+
+	switch {
+	case uaTablet.MatchString(s), ua.Os == "Android" && !uaMobile.MatchString(s):
+		ua.Device = "tablet"
+	case uaMobile.MatchString(s):
+		ua.Device = "mobile"
+	case ua.Browser != "" || ua.Os != "":
+		ua.Device = "desktop"
+	default:
+		ua.Device = "unknown"
+	}
+	return ua
+}
+
+// agentClass is the NGINX_GROUP_BY=agent key: the bot class, or browser.
+func agentClass(v Nginx) string {
+	if v.Ua == nil {
+		return ""
+	}
+	if v.Ua.Bot {
+		return v.Ua.Bot_class
+	}
+	return "browser"
+}